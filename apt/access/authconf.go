@@ -0,0 +1,295 @@
+package access
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AuthConfEntry is a 'machine' entry of an auth.conf-style service token
+// file, giving the service token used for the URIs it matches.
+//
+// Entries are written in the style of apt's auth.conf:
+//
+//	machine apt.example.com/team-a/ client-id ${ID}.access client-secret ${SECRET}
+//	machine *.example.com:8443 client-id ${ID}.access client-secret ${SECRET}
+//
+// The machine is a host name, optionally followed by a port and a path. A
+// host name of *.${DOMAIN} matches every host under the domain. Everything
+// from a '#' to the end of the line is a comment.
+type AuthConfEntry struct {
+	// Host is the host name the entry matches, or *.${DOMAIN} to match
+	// every host under the domain.
+	Host string
+
+	// Port is the port the entry matches. If it is empty, the entry
+	// matches any port.
+	Port string
+
+	// Path is the path prefix the entry matches. If it is empty, the entry
+	// matches every path.
+	Path string
+
+	// Token is the service token for the matching URIs.
+	Token *ServiceToken
+}
+
+// ParseAuthConf parses the entries of an auth.conf-style service token file.
+func ParseAuthConf(r io.Reader) ([]AuthConfEntry, error) {
+	var entries []AuthConfEntry
+	var entry *AuthConfEntry
+
+	// finish checks the entry being parsed and adds it to the list
+	finish := func() error {
+		if entry == nil {
+			return nil
+		}
+		if entry.Token.ID == "" || entry.Token.Secret == "" {
+			return fmt.Errorf("machine %s needs a client-id and a client-secret", entry.Host)
+		}
+		entries = append(entries, *entry)
+		entry = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		for i := 0; i < len(fields); i += 2 {
+			keyword := fields[i]
+			if strings.HasPrefix(keyword, "#") {
+				break
+			}
+			if i+1 >= len(fields) || strings.HasPrefix(fields[i+1], "#") {
+				return nil, fmt.Errorf("line %d: %s needs a value", lineno, keyword)
+			}
+			value := fields[i+1]
+
+			switch strings.ToLower(keyword) {
+			case "machine":
+				if err := finish(); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineno, err)
+				}
+				entry = parseMachine(value)
+			case "client-id", "client-secret":
+				if entry == nil {
+					return nil, fmt.Errorf("line %d: %s outside of a machine entry", lineno, keyword)
+				}
+				if strings.EqualFold(keyword, "client-id") {
+					entry.Token.ID = value
+				} else {
+					entry.Token.Secret = value
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown keyword %q", lineno, keyword)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := finish(); err != nil {
+		return nil, fmt.Errorf("at end of file: %v", err)
+	}
+	return entries, nil
+}
+
+// parseMachine parses the value of a 'machine' keyword, which is a host
+// optionally followed by a port and a path. A https:// prefix is ignored.
+func parseMachine(machine string) *AuthConfEntry {
+	machine = strings.TrimPrefix(machine, "cfd+")
+	machine = strings.TrimPrefix(machine, "https://")
+
+	entry := &AuthConfEntry{Token: &ServiceToken{}}
+	if i := strings.Index(machine, "/"); i >= 0 {
+		machine, entry.Path = machine[:i], strings.TrimSuffix(machine[i:], "/")
+	}
+
+	host := stripPort(machine)
+	if len(host) < len(machine) {
+		entry.Port = machine[len(host)+1:]
+	}
+	entry.Host = strings.ToLower(strings.Trim(host, "[]"))
+	return entry
+}
+
+// Matches reports whether the entry applies to the URI.
+func (e *AuthConfEntry) Matches(uri *url.URL) bool {
+	host := strings.ToLower(uri.Hostname())
+	if strings.HasPrefix(e.Host, "*.") {
+		if !strings.HasSuffix(host, e.Host[1:]) {
+			return false
+		}
+	} else if host != e.Host {
+		return false
+	}
+
+	if e.Port != "" {
+		port := uri.Port()
+		if port == "" {
+			port = "443"
+		}
+		if port != e.Port {
+			return false
+		}
+	}
+	return underPath(uri.Path, e.Path)
+}
+
+// MatchAuthConf returns the entry which applies to the URI, or nil if none
+// do.
+//
+// If several entries match, the one with the longest path wins. Between
+// entries with the same path, an exact host beats a wildcard and an entry
+// with a port beats one without, and otherwise the first entry wins.
+func MatchAuthConf(entries []AuthConfEntry, uri *url.URL) *AuthConfEntry {
+	var best *AuthConfEntry
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Matches(uri) && (best == nil || entry.moreSpecific(best)) {
+			best = entry
+		}
+	}
+	return best
+}
+
+// moreSpecific reports whether the entry is more specific than other.
+func (e *AuthConfEntry) moreSpecific(other *AuthConfEntry) bool {
+	if len(e.Path) != len(other.Path) {
+		return len(e.Path) > len(other.Path)
+	}
+
+	wildcard, otherWildcard := strings.HasPrefix(e.Host, "*."), strings.HasPrefix(other.Host, "*.")
+	if wildcard != otherWildcard {
+		return !wildcard
+	}
+	return e.Port != "" && other.Port == ""
+}
+
+// LoadAuthConfDir loads the entries of every auth.conf-style file, named
+// *.conf, in the directory, in the order of the file names.
+//
+// Files which other users could read or replace are refused, unless
+// allowInsecure is set. If warn is set, it is called with a warning for each
+// file which can't be read, and the file is skipped, and for each insecure
+// file which is allowed. It is not an error for the directory not to exist.
+func LoadAuthConfDir(dir string, allowInsecure bool, warn func(string)) ([]AuthConfEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var entries []AuthConfEntry
+	for _, file := range files {
+		data, err := readTokenFile(file, allowInsecure, warn)
+		if os.IsPermission(err) {
+			warnUnreadable(warn, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := ParseAuthConf(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		entries = append(entries, parsed...)
+	}
+	return entries, nil
+}
+
+// AuthConfCache keeps the entries of the auth.conf-style files in each
+// service token directory, so that the files are only read once.
+type AuthConfCache struct {
+	mu   sync.Mutex
+	dirs map[authConfKey]*authConfDir
+}
+
+// authConfKey identifies the loaded entries of a directory. Whether insecure
+// files are allowed may be set for a single host, and changes which files are
+// used.
+type authConfKey struct {
+	dir           string
+	allowInsecure bool
+}
+
+// authConfDir holds the result of loading a directory with LoadAuthConfDir.
+type authConfDir struct {
+	entries []AuthConfEntry
+	err     error
+}
+
+// NewAuthConfCache creates an empty AuthConfCache.
+func NewAuthConfCache() *AuthConfCache {
+	return &AuthConfCache{dirs: make(map[authConfKey]*authConfDir)}
+}
+
+// Load returns the entries of the directory, loading them with
+// LoadAuthConfDir the first time the directory is used. Errors are kept as
+// well, so a file which can't be parsed is reported every time, while
+// warnings are only given the first time.
+func (c *AuthConfCache) Load(dir string, allowInsecure bool, warn func(string)) ([]AuthConfEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := authConfKey{dir, allowInsecure}
+	loaded := c.dirs[key]
+	if loaded == nil {
+		loaded = &authConfDir{}
+		loaded.entries, loaded.err = LoadAuthConfDir(dir, allowInsecure, warn)
+		c.dirs[key] = loaded
+	}
+	return loaded.entries, loaded.err
+}
+
+// loadAuthConf loads the entries of the directory from the cache, or from the
+// directory if cache is nil.
+func loadAuthConf(cache *AuthConfCache, dir string, allowInsecure bool, warn func(string)) ([]AuthConfEntry, error) {
+	if cache == nil {
+		return LoadAuthConfDir(dir, allowInsecure, warn)
+	}
+	return cache.Load(dir, allowInsecure, warn)
+}
+
+// authConfScope returns the path of the auth.conf entry which applies to the
+// URI in the service token directories in opts, or "" if there is none or
+// service tokens aren't used.
+//
+// Each path with its own entry may have its own service token, so tokens are
+// cached separately for each of them.
+func authConfScope(uri *url.URL, opts *Options) (string, error) {
+	if !usesProvider(opts, ProviderServiceToken) {
+		return "", nil
+	}
+
+	for _, dir := range []string{opts.SystemTokenDir, opts.ServiceTokenDir} {
+		if dir == "" {
+			continue
+		}
+		entries, err := loadAuthConf(opts.AuthConf, dir, opts.AllowInsecureTokens, opts.Warn)
+		if err != nil {
+			return "", err
+		}
+		if entry := MatchAuthConf(entries, uri); entry != nil {
+			return entry.Path, nil
+		}
+	}
+	return "", nil
+}
+
+// underPath reports whether the path is prefix, or is below it. Every path
+// is under the empty prefix.
+func underPath(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
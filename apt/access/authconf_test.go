@@ -0,0 +1,156 @@
+package access
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAuthConf(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     string
+		expected []AuthConfEntry
+		errors   bool
+	}{
+		{
+			name: "Entries",
+			conf: `# Team repositories
+machine apt.example.com/team-a/ client-id a.access client-secret secret-a
+machine https://APT.example.com:8443/team-b
+  client-id b.access   # on its own line
+  client-secret secret-b
+machine *.example.com client-id shared.access client-secret shared
+`,
+			expected: []AuthConfEntry{
+				{Host: "apt.example.com", Path: "/team-a", Token: &ServiceToken{"a.access", "secret-a"}},
+				{
+					Host:  "apt.example.com",
+					Port:  "8443",
+					Path:  "/team-b",
+					Token: &ServiceToken{"b.access", "secret-b"},
+				},
+				{Host: "*.example.com", Token: &ServiceToken{"shared.access", "shared"}},
+			},
+		},
+		{
+			name: "Empty",
+			conf: "\n# Nothing here\n",
+		},
+		{
+			name:   "Missing Secret",
+			conf:   "machine apt.example.com client-id a.access\n",
+			errors: true,
+		},
+		{
+			name:   "Missing Value",
+			conf:   "machine apt.example.com client-id a.access client-secret\n",
+			errors: true,
+		},
+		{
+			name:   "Unknown Keyword",
+			conf:   "machine apt.example.com login user password secret\n",
+			errors: true,
+		},
+		{
+			name:   "No Machine",
+			conf:   "client-id a.access client-secret secret\n",
+			errors: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := ParseAuthConf(strings.NewReader(test.conf))
+			if test.errors {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, entries)
+		})
+	}
+}
+
+func TestMatchAuthConf(t *testing.T) {
+	entries, err := ParseAuthConf(strings.NewReader(`
+machine *.example.com client-id wildcard.access client-secret s
+machine apt.example.com client-id host.access client-secret s
+machine apt.example.com:8443 client-id port.access client-secret s
+machine apt.example.com/team-a client-id team-a.access client-secret s
+machine apt.example.com/team-a/stable/ client-id stable.access client-secret s
+machine *.example.com/team-b client-id team-b.access client-secret s
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		uri      string
+		expected string
+	}{
+		{"https://apt.example.com/debian/pkg.deb", "host.access"},
+		{"https://apt.example.com:443/debian/pkg.deb", "host.access"},
+		{"https://apt.example.com:8443/debian/pkg.deb", "port.access"},
+		{"https://apt.example.com/team-a/pkg.deb", "team-a.access"},
+		{"https://apt.example.com:8443/team-a/pkg.deb", "team-a.access"},
+		{"https://apt.example.com/team-a", "team-a.access"},
+		{"https://apt.example.com/team-ab/pkg.deb", "host.access"},
+		{"https://apt.example.com/team-a/stable/pkg.deb", "stable.access"},
+		{"https://apt.example.com/team-b/pkg.deb", "team-b.access"},
+		{"https://deb.example.com/debian/pkg.deb", "wildcard.access"},
+		{"https://a.b.example.com/debian/pkg.deb", "wildcard.access"},
+		{"https://example.com/debian/pkg.deb", ""},
+		{"https://apt.example.org/debian/pkg.deb", ""},
+	}
+
+	for _, test := range tests {
+		uri, err := url.Parse(test.uri)
+		require.NoError(t, err)
+
+		entry := MatchAuthConf(entries, uri)
+		if test.expected == "" {
+			assert.Nil(t, entry, test.uri)
+			continue
+		}
+		if assert.NotNil(t, entry, test.uri) {
+			assert.Equal(t, test.expected, entry.Token.ID, test.uri)
+		}
+	}
+}
+
+func TestServiceTokenProviderAuthConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-authconf-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+	}
+	write("teams.conf", "machine apt.example.com/team-a/ client-id a.access client-secret secret-a\n")
+	write("shared.conf", "machine *.example.com client-id shared.access client-secret shared\n")
+	write("apt.example.com-Service-Token", "host.access\nsecret\n")
+	write("other.example.org-Service-Token", "host.other.example.org\nsecret\n")
+
+	provider := &ServiceTokenProvider{Dirs: []string{dir}}
+	token := func(uri string) Token {
+		parsed, err := url.Parse(uri)
+		require.NoError(t, err)
+		token, err := provider.Token(context.Background(), parsed)
+		require.NoError(t, err)
+		return token
+	}
+
+	assert.Equal(t, &ServiceToken{"a.access", "secret-a"}, token("https://apt.example.com/team-a/pkg.deb"))
+	assert.Equal(t, &ServiceToken{"shared.access", "shared"}, token("https://apt.example.com/team-b/pkg.deb"))
+	assert.Equal(t, &ServiceToken{"host.other.example.org", "secret"}, token("https://other.example.org/pkg.deb"))
+
+	write("broken.conf", "machine apt.example.com\n")
+	_, err = provider.Token(context.Background(), &url.URL{Host: "other.example.org"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expirySkew is how long before a token expires the cache stops using it, so
+// that a token doesn't expire while a download is in flight.
+const expirySkew = time.Minute
+
+// TokenCache is an in-memory cache of tokens.
+//
+// Tokens are cached until shortly before they expire. If several goroutines
+// ask for the same key at once, only one of them fetches the token and the
+// others wait for its result.
+type TokenCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	now     func() time.Time
+
+	// rejected holds the keys which have been invalidated, for which stored
+	// tokens must not be reused until a new token has been fetched.
+	rejected map[string]bool
+
+	// authConf holds the auth.conf-style service token files, which are
+	// needed to work out the key of every URI, so that they are only read
+	// once. It is used unless Options.AuthConf is set.
+	authConf *AuthConfCache
+}
+
+// cacheEntry is a token in the cache, or a fetch which is still running.
+type cacheEntry struct {
+	done     chan struct{}
+	token    Token
+	provider string
+	expires  time.Time
+	err      error
+}
+
+// NewTokenCache creates an empty TokenCache.
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		entries:  make(map[string]*cacheEntry),
+		now:      time.Now,
+		rejected: make(map[string]bool),
+		authConf: NewAuthConfCache(),
+	}
+}
+
+// CacheKey returns the key tokens for the given URI are cached under.
+//
+// Access applications are identified by host, which is also how cloudflared
+// stores its tokens, so a token can be shared by every path on a host. The
+// paths with their own service tokens in auth.conf-style files are cached
+// separately, under this key followed by the path.
+func CacheKey(uri *url.URL) string {
+	return uri.Host
+}
+
+// GetToken returns the cached token for the given URI, calling GetToken to
+// get a new one if there is no valid token in the cache.
+func (tc *TokenCache) GetToken(ctx context.Context, uri *url.URL, opts *Options) (Token, error) {
+	token, _, err := tc.GetTokenFrom(ctx, uri, opts)
+	return token, err
+}
+
+// GetTokenFrom is like GetToken, but also returns the name of the provider
+// which produced the token.
+//
+// If the token for the URI has been invalidated, the new token is fetched
+// with opts.Refresh set, so that the rejected token isn't loaded again.
+func (tc *TokenCache) GetTokenFrom(ctx context.Context, uri *url.URL, opts *Options) (Token, string, error) {
+	if opts.AuthConf == nil {
+		cached := *opts
+		cached.AuthConf = tc.authConf
+		opts = &cached
+	}
+
+	host := CacheKey(uri)
+	scope, err := authConfScope(uri, opts)
+	if err != nil {
+		return nil, ProviderServiceToken, fmt.Errorf("%s: %w", ProviderServiceToken, err)
+	}
+
+	key := host + scope
+	entry, err := tc.get(ctx, key, func(ctx context.Context) (Token, string, error) {
+		tc.mu.Lock()
+		rejected := tc.rejected[host]
+		tc.mu.Unlock()
+
+		if rejected && !opts.Refresh {
+			refresh := *opts
+			refresh.Refresh = true
+			opts = &refresh
+		}
+
+		token, provider, err := GetTokenFrom(ctx, uri, opts)
+		if err == nil && rejected {
+			tc.mu.Lock()
+			delete(tc.rejected, host)
+			tc.mu.Unlock()
+		}
+		return token, provider, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entry.token, entry.provider, nil
+}
+
+// Get returns the token cached under key, calling fetch to get a new one if
+// there is no valid token in the cache.
+//
+// Errors returned by fetch are not cached.
+func (tc *TokenCache) Get(ctx context.Context, key string,
+	fetch func(context.Context) (Token, error)) (Token, error) {
+	entry, err := tc.get(ctx, key, func(ctx context.Context) (Token, string, error) {
+		token, err := fetch(ctx)
+		return token, "", err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.token, nil
+}
+
+// get returns the entry cached under key, calling fetch to fill in a new
+// entry if there is no valid one in the cache.
+func (tc *TokenCache) get(ctx context.Context, key string,
+	fetch func(context.Context) (Token, string, error)) (*cacheEntry, error) {
+	tc.mu.Lock()
+	entry, ok := tc.entries[key]
+	if ok && tc.valid(entry) {
+		tc.mu.Unlock()
+		return tc.wait(ctx, entry)
+	}
+
+	entry = &cacheEntry{done: make(chan struct{})}
+	tc.entries[key] = entry
+	tc.mu.Unlock()
+
+	entry.token, entry.provider, entry.err = fetch(ctx)
+	if entry.err == nil {
+		entry.expires = tokenExpiry(entry.token)
+	}
+
+	tc.mu.Lock()
+	if entry.err != nil && tc.entries[key] == entry {
+		delete(tc.entries, key)
+	}
+	tc.mu.Unlock()
+	close(entry.done)
+
+	return entry, entry.err
+}
+
+// Invalidate removes the token cached under key, or for a path under it,
+// because it was rejected. Only the rejected token is removed, so that when
+// several requests are rejected at once, the token fetched after the first
+// rejection isn't thrown away as well.
+//
+// Until a new token has been fetched for key, stored tokens aren't reused.
+func (tc *TokenCache) Invalidate(key string, rejected Token) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for cached, entry := range tc.entries {
+		if cached != key && !strings.HasPrefix(cached, key+"/") {
+			continue
+		}
+
+		// Entries which are still being fetched hold new tokens
+		select {
+		case <-entry.done:
+		default:
+			continue
+		}
+		if entry.token == rejected {
+			delete(tc.entries, cached)
+			tc.rejected[key] = true
+		}
+	}
+}
+
+// valid reports whether the entry can still be used. Entries which are being
+// fetched are always valid. The caller must hold tc.mu.
+func (tc *TokenCache) valid(entry *cacheEntry) bool {
+	select {
+	case <-entry.done:
+	default:
+		return true
+	}
+	return entry.expires.IsZero() || tc.now().Add(expirySkew).Before(entry.expires)
+}
+
+// wait blocks until the entry has been fetched or the context is done.
+func (tc *TokenCache) wait(ctx context.Context, entry *cacheEntry) (*cacheEntry, error) {
+	select {
+	case <-entry.done:
+		return entry, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tokenExpiry returns the time a token expires, or the zero time if it
+// doesn't expire or the expiry is unknown.
+func tokenExpiry(token Token) time.Time {
+	ut, ok := token.(*UserToken)
+	if !ok {
+		return time.Time{}
+	}
+	if !ut.Expires.IsZero() {
+		return ut.Expires
+	}
+
+	claims, err := ParseClaims(ut.JWT)
+	if err != nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt()
+}
@@ -0,0 +1,260 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCacheExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	cache := NewTokenCache()
+	cache.now = func() time.Time { return now }
+
+	var fetches int
+	fetch := func(ctx context.Context) (Token, error) {
+		fetches++
+		exp := now.Add(10 * time.Minute).Unix()
+		return &UserToken{JWT: makeJWT(fmt.Sprintf(`{"exp":%d}`, exp))}, nil
+	}
+
+	ctx := context.Background()
+	first, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+
+	// Still well within the expiry time
+	now = now.Add(5 * time.Minute)
+	second, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, fetches)
+
+	// Within expirySkew of expiring, so a new token is fetched
+	now = now.Add(4*time.Minute + 30*time.Second)
+	third, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, third)
+	assert.Equal(t, 2, fetches)
+
+	// Other keys are cached separately
+	_, err = cache.Get(ctx, "other", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fetches)
+
+	cache.Invalidate("host", third)
+	_, err = cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fetches)
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	cache := NewTokenCache()
+
+	var fetches int
+	fetch := func(ctx context.Context) (Token, error) {
+		fetches++
+		return &ServiceToken{fmt.Sprintf("id-%d", fetches), "secret"}, nil
+	}
+
+	ctx := context.Background()
+	first, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+
+	// Requests which were sent with the same token are rejected together,
+	// but only the first rejection replaces it
+	cache.Invalidate("host", first)
+	second, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	cache.Invalidate("host", first)
+	token, err := cache.Get(ctx, "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, second, token)
+	assert.Equal(t, 2, fetches)
+
+	// Tokens for other hosts aren't affected
+	other, err := cache.Get(ctx, "other", fetch)
+	require.NoError(t, err)
+	cache.Invalidate("host", other)
+	token, err = cache.Get(ctx, "other", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, other, token)
+	assert.Equal(t, 3, fetches)
+}
+
+func TestTokenCacheErrors(t *testing.T) {
+	cache := NewTokenCache()
+
+	var fetches int
+	fetch := func(ctx context.Context) (Token, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("login failed")
+		}
+		return &ServiceToken{"id", "secret"}, nil
+	}
+
+	_, err := cache.Get(context.Background(), "host", fetch)
+	assert.Error(t, err)
+
+	token, err := cache.Get(context.Background(), "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"id", "secret"}, token)
+
+	// Service tokens don't expire
+	_, err = cache.Get(context.Background(), "host", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestTokenCacheSingleFlight(t *testing.T) {
+	cache := NewTokenCache()
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (Token, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &UserToken{JWT: "token"}, nil
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]Token, 8)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok, err := cache.Get(context.Background(), "host", fetch)
+			assert.NoError(t, err)
+			tokens[i] = tok
+		}(i)
+	}
+
+	// Give the goroutines a chance to pile up behind the first fetch
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	for _, tok := range tokens {
+		assert.Equal(t, &UserToken{JWT: "token"}, tok)
+	}
+
+	// Waiters give up when their context is done
+	cache.Invalidate("host", tokens[0])
+	block := make(chan struct{})
+	go cache.Get(context.Background(), "host", func(ctx context.Context) (Token, error) { // nolint: errcheck
+		<-block
+		return &UserToken{JWT: "token"}, nil
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cache.Get(ctx, "host", fetch)
+	assert.Equal(t, context.Canceled, err)
+	close(block)
+}
+
+func TestTokenCacheAuthConfPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+	}
+	write("teams.conf", `machine apt.example.com/team-a client-id a.access client-secret a
+machine apt.example.com/team-b client-id b.access client-secret b
+`)
+	write("apt.example.com-Service-Token", "host.access\nsecret\n")
+
+	cache := NewTokenCache()
+	opts := &Options{Providers: []string{ProviderServiceToken}, ServiceTokenDir: dir}
+	clientID := func(uri string) string {
+		parsed, err := url.Parse(uri)
+		require.NoError(t, err)
+		token, err := cache.GetToken(context.Background(), parsed, opts)
+		require.NoError(t, err)
+		return token.(*ServiceToken).ID
+	}
+
+	uris := map[string]string{
+		"https://apt.example.com/team-a/pkg.deb": "a.access",
+		"https://apt.example.com/team-b/pkg.deb": "b.access",
+		"https://apt.example.com/debian/pkg.deb": "host.access",
+	}
+	for uri, expected := range uris {
+		assert.Equal(t, expected, clientID(uri), uri)
+	}
+
+	// Every token is cached, and used only for its own paths
+	require.NoError(t, os.Remove(filepath.Join(dir, "apt.example.com-Service-Token")))
+	for uri, expected := range uris {
+		assert.Equal(t, expected, clientID(uri), uri)
+	}
+
+	// Invalidating the host drops the rejected token, whichever path it was
+	// cached for, and no others
+	teamA, err := url.Parse("https://apt.example.com/team-a/pkg.deb")
+	require.NoError(t, err)
+	teamB, err := url.Parse("https://apt.example.com/team-b/pkg.deb")
+	require.NoError(t, err)
+	rejected, err := cache.GetToken(context.Background(), teamA, opts)
+	require.NoError(t, err)
+	other, err := cache.GetToken(context.Background(), teamB, opts)
+	require.NoError(t, err)
+
+	cache.Invalidate("apt.example.com", rejected)
+	token, err := cache.GetToken(context.Background(), teamA, opts)
+	require.NoError(t, err)
+	assert.False(t, token == rejected, "rejected token was still cached")
+	token, err = cache.GetToken(context.Background(), teamB, opts)
+	require.NoError(t, err)
+	assert.True(t, token == other, "other token was dropped")
+
+	// The auth.conf-style files are only read once
+	write("teams.conf", "machine apt.example.com/team-a client-id a2.apt.example.com client-secret a\n")
+	cache.Invalidate("apt.example.com", token)
+	assert.Equal(t, "a.access", clientID("https://apt.example.com/team-a/pkg.deb"))
+}
+
+func TestTokenCacheAuthConfErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "broken.conf"), []byte("machine apt.example.com\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "apt.example.com-Service-Token"),
+		[]byte("host.access\nsecret\n"), 0600))
+
+	uri, err := url.Parse("https://apt.example.com/debian/pkg.deb")
+	require.NoError(t, err)
+
+	// A file which can't be parsed is an error when service tokens are used
+	cache := NewTokenCache()
+	opts := &Options{ServiceTokenDir: dir, Providers: []string{"env", "service-token"}}
+	_, err = cache.GetToken(context.Background(), uri, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken.conf")
+
+	// and the files aren't read at all when they aren't
+	t.Setenv(EnvServiceTokenID, "env.apt.example.com")
+	t.Setenv(EnvServiceTokenSecret, "secret")
+	opts.Providers = []string{"env"}
+	token, err := cache.GetToken(context.Background(), uri, opts)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"env.apt.example.com", "secret"}, token)
+}
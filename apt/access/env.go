@@ -0,0 +1,144 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The environment variables service tokens are read from.
+//
+// A service token for a single host is read from the variables with the host
+// appended, e.g. CFD_SERVICE_TOKEN_ID_APT_EXAMPLE_COM; see EnvHostSuffix. The
+// variables without a host hold a service token used for every host.
+const (
+	EnvServiceTokenID     = "CFD_SERVICE_TOKEN_ID"
+	EnvServiceTokenSecret = "CFD_SERVICE_TOKEN_SECRET"
+
+	// EnvCredentialsDirectory is set by systemd to the directory holding the
+	// credentials passed to a unit with LoadCredential= or SetCredential=.
+	EnvCredentialsDirectory = "CREDENTIALS_DIRECTORY"
+)
+
+// GlobalServiceTokenName is the name of the systemd credential holding a
+// service token used for every host. Service tokens for a single host are
+// named ${HOST}-Service-Token, as in a service token directory.
+const GlobalServiceTokenName = "Service-Token"
+
+// EnvHostSuffix returns the suffix added to the service token environment
+// variables for the host: the host in upper case, with every character other
+// than a letter or a digit replaced by an underscore.
+func EnvHostSuffix(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// EnvProvider loads service tokens from environment variables. The variables
+// for the host are preferred to the global ones.
+type EnvProvider struct{}
+
+// Name implements the TokenProvider interface.
+func (p *EnvProvider) Name() string {
+	return ProviderEnv
+}
+
+// Token implements the TokenProvider interface.
+//
+// The provider isn't applicable if none of the variables are set.
+func (p *EnvProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	suffix := "_" + EnvHostSuffix(uri.Host)
+	token, err := serviceTokenFromEnv(EnvServiceTokenID+suffix, EnvServiceTokenSecret+suffix)
+	if err != nil {
+		return nil, err
+	}
+	if token != nil {
+		return token, nil
+	}
+
+	token, err = serviceTokenFromEnv(EnvServiceTokenID, EnvServiceTokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, fmt.Errorf("%w: %s is not set", ErrNotApplicable, EnvServiceTokenID)
+	}
+	return token, nil
+}
+
+// serviceTokenFromEnv returns the service token in the environment variables
+// id and secret. It returns nil if neither variable is set, and an error if
+// only one of them is.
+func serviceTokenFromEnv(id, secret string) (*ServiceToken, error) {
+	idValue, secretValue := os.Getenv(id), os.Getenv(secret)
+	if idValue == "" && secretValue == "" {
+		return nil, nil
+	}
+	if idValue == "" || secretValue == "" {
+		return nil, fmt.Errorf("%s and %s must both be set", id, secret)
+	}
+	return ParseServiceToken(idValue + "\n" + secretValue)
+}
+
+// CredentialsProvider loads service tokens from systemd credentials, which
+// are files in the directory named by $CREDENTIALS_DIRECTORY. The credential
+// for the host is preferred to the global one.
+type CredentialsProvider struct {
+	Dir string
+
+	// AllowInsecure uses credentials which other users could read or
+	// replace, rather than refusing them. See LoadServiceToken.
+	AllowInsecure bool
+
+	// Warn, if set, is called with a warning for each credential which
+	// can't be read, or is insecure but allowed.
+	Warn func(msg string)
+}
+
+// Name implements the TokenProvider interface.
+func (p *CredentialsProvider) Name() string {
+	return ProviderCredentials
+}
+
+// Token implements the TokenProvider interface.
+//
+// The provider isn't applicable if no credentials were passed, or neither
+// credential is readable.
+func (p *CredentialsProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	if p.Dir == "" {
+		return nil, fmt.Errorf("%w: %s is not set", ErrNotApplicable, EnvCredentialsDirectory)
+	}
+
+	filename := filepath.Join(p.Dir, uri.Host+"-Service-Token")
+	token, err := loadServiceToken(filename, p.AllowInsecure, p.Warn)
+	if err == nil {
+		return token, nil
+	}
+	if os.IsPermission(err) {
+		warnUnreadable(p.Warn, err)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	filename = filepath.Join(p.Dir, GlobalServiceTokenName)
+	token, err = loadServiceToken(filename, p.AllowInsecure, p.Warn)
+	if os.IsPermission(err) {
+		warnUnreadable(p.Warn, err)
+	}
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNotApplicable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,164 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvHostSuffix(t *testing.T) {
+	assert.Equal(t, "APT_EXAMPLE_COM", EnvHostSuffix("apt.example.com"))
+	assert.Equal(t, "APT_EXAMPLE_COM_8443", EnvHostSuffix("apt.example.com:8443"))
+	assert.Equal(t, "APT_2_EXAMPLE_COM", EnvHostSuffix("Apt-2.example.com"))
+}
+
+func TestEnvProvider(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		host          string
+		expected      Token
+		notApplicable bool
+		errors        bool
+	}{
+		{
+			name: "Host",
+			env: map[string]string{
+				"CFD_SERVICE_TOKEN_ID_APT_EXAMPLE_COM":     "id.access",
+				"CFD_SERVICE_TOKEN_SECRET_APT_EXAMPLE_COM": "secret",
+				"CFD_SERVICE_TOKEN_ID":                     "global.access",
+				"CFD_SERVICE_TOKEN_SECRET":                 "global-secret",
+			},
+			host:     "apt.example.com",
+			expected: &ServiceToken{ID: "id.access", Secret: "secret"},
+		},
+		{
+			name: "Host With Port",
+			env: map[string]string{
+				"CFD_SERVICE_TOKEN_ID_APT_EXAMPLE_COM_8443":     "id.access",
+				"CFD_SERVICE_TOKEN_SECRET_APT_EXAMPLE_COM_8443": "secret",
+			},
+			host:     "apt.example.com:8443",
+			expected: &ServiceToken{ID: "id.access", Secret: "secret"},
+		},
+		{
+			name: "Global",
+			env: map[string]string{
+				"CFD_SERVICE_TOKEN_ID":     "global.access",
+				"CFD_SERVICE_TOKEN_SECRET": "global-secret",
+			},
+			host:     "apt.example.com",
+			expected: &ServiceToken{ID: "global.access", Secret: "global-secret"},
+		},
+		{
+			name:   "Missing Secret",
+			env:    map[string]string{"CFD_SERVICE_TOKEN_ID": "global.access"},
+			host:   "apt.example.com",
+			errors: true,
+		},
+		{
+			name:          "Unset",
+			host:          "apt.example.com",
+			notApplicable: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"CFD_SERVICE_TOKEN_ID", "CFD_SERVICE_TOKEN_SECRET"} {
+				t.Setenv(name, "")
+				t.Setenv(name+"_"+EnvHostSuffix(test.host), "")
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			provider := &EnvProvider{}
+			token, err := provider.Token(context.Background(), &url.URL{Host: test.host})
+			switch {
+			case test.notApplicable:
+				assert.True(t, errors.Is(err, ErrNotApplicable), "unexpected error %v", err)
+				assert.Nil(t, token)
+			case test.errors:
+				assert.Error(t, err)
+				assert.False(t, errors.Is(err, ErrNotApplicable))
+				assert.Nil(t, token)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, token)
+			}
+		})
+	}
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expected      Token
+		notApplicable bool
+		errors        bool
+	}{
+		{
+			name: "Host",
+			files: map[string]string{
+				"apt.example.com-Service-Token": "id.access\nsecret\n",
+				"Service-Token":                 "global.access\nglobal-secret\n",
+			},
+			expected: &ServiceToken{ID: "id.access", Secret: "secret"},
+		},
+		{
+			name:     "Global",
+			files:    map[string]string{"Service-Token": "global.access\nglobal-secret\n"},
+			expected: &ServiceToken{ID: "global.access", Secret: "global-secret"},
+		},
+		{
+			name:   "Malformed",
+			files:  map[string]string{"apt.example.com-Service-Token": "id.access\n"},
+			errors: true,
+		},
+		{
+			name:          "Missing",
+			files:         map[string]string{"other.example.com-Service-Token": "id.access\nsecret\n"},
+			notApplicable: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cfd-credentials-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			for name, data := range test.files {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0400))
+			}
+
+			provider := &CredentialsProvider{Dir: dir}
+			token, err := provider.Token(context.Background(), &url.URL{Host: "apt.example.com"})
+			switch {
+			case test.notApplicable:
+				assert.True(t, errors.Is(err, ErrNotApplicable), "unexpected error %v", err)
+				assert.Nil(t, token)
+			case test.errors:
+				assert.Error(t, err)
+				assert.False(t, errors.Is(err, ErrNotApplicable))
+				assert.Nil(t, token)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, token)
+			}
+		})
+	}
+
+	provider := &CredentialsProvider{}
+	_, err := provider.Token(context.Background(), &url.URL{Host: "apt.example.com"})
+	assert.True(t, errors.Is(err, ErrNotApplicable))
+}
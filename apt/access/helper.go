@@ -0,0 +1,175 @@
+package access
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/exec"
+)
+
+// defaultHelperTimeout is how long a credential helper may run if no timeout
+// is configured.
+const defaultHelperTimeout = 30 * time.Second
+
+// HelperRequest is the JSON object written to the stdin of a credential
+// helper.
+//
+// Tokens are cached per host, and used for every path on it, so the helper
+// is only told the host.
+type HelperRequest struct {
+	// Host is the host (and port, if any) a token is needed for.
+	Host string `json:"host"`
+}
+
+// HelperResponse is the JSON object a credential helper writes to stdout.
+//
+// A helper returns either a service token, as client_id and client_secret,
+// or a user token, as jwt and optionally expires_at. expires_at is either an
+// RFC 3339 time or a number of seconds since the epoch. A helper which has
+// no token for the host writes nothing, or an empty object.
+type HelperResponse struct {
+	ClientID     string          `json:"client_id"`
+	ClientSecret string          `json:"client_secret"`
+	JWT          string          `json:"jwt"`
+	ExpiresAt    json.RawMessage `json:"expires_at"`
+}
+
+// HelperTimeoutError is returned when a credential helper runs for longer
+// than it may.
+type HelperTimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *HelperTimeoutError) Error() string {
+	return fmt.Sprintf("credential helper %s timed out after %v", e.Command, e.Timeout)
+}
+
+// HelperProvider gets tokens by running a credential helper, similar to the
+// credential helpers used by git and docker.
+//
+// The helper is run without a shell, and is given a HelperRequest on stdin.
+// It must write a HelperResponse to stdout and exit successfully. Anything it
+// writes to stderr is included in the error if it fails.
+type HelperProvider struct {
+	// Command is the path or name of the helper to run. It is used as is, so
+	// it may contain spaces.
+	Command string
+
+	// Args are the arguments the helper is run with.
+	Args []string
+
+	// Timeout is how long the helper may run. If it is 0, the helper may run
+	// for 30 seconds.
+	Timeout time.Duration
+}
+
+// Name implements the TokenProvider interface.
+func (p *HelperProvider) Name() string {
+	return ProviderHelper
+}
+
+// Token implements the TokenProvider interface.
+//
+// The provider isn't applicable if no helper is configured, or the helper has
+// no token for the host.
+func (p *HelperProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	if strings.TrimSpace(p.Command) == "" {
+		return nil, fmt.Errorf("%w: no credential helper", ErrNotApplicable)
+	}
+
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = defaultHelperTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := json.Marshal(&HelperRequest{Host: uri.Host})
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &HelperTimeoutError{Command: p.Command, Timeout: timeout}
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %v: %s", p.Command, err, msg)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v", p.Command, err)
+	}
+
+	token, err := ParseHelperResponse(output, time.Now())
+	if err != nil && !errors.Is(err, ErrNotApplicable) {
+		return nil, fmt.Errorf("credential helper %s: %w", p.Command, err)
+	}
+	return token, err
+}
+
+// ParseHelperResponse parses the output of a credential helper into a token.
+//
+// It returns an error wrapping ErrNotApplicable if the helper has no token,
+// and an error if the token has expired by now.
+func ParseHelperResponse(output []byte, now time.Time) (Token, error) {
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return nil, fmt.Errorf("%w: credential helper has no token", ErrNotApplicable)
+	}
+
+	var resp HelperResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+
+	switch {
+	case resp.ClientID != "" || resp.ClientSecret != "":
+		if resp.ClientID == "" || resp.ClientSecret == "" {
+			return nil, errors.New("invalid response: client_id and client_secret must both be set")
+		}
+		return &ServiceToken{ID: resp.ClientID, Secret: resp.ClientSecret}, nil
+	case resp.JWT != "":
+		expires, err := parseExpiresAt(resp.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		if !expires.IsZero() && !expires.After(now) {
+			return nil, fmt.Errorf("token expired at %v", expires)
+		}
+		return &UserToken{JWT: resp.JWT, Expires: expires}, nil
+	}
+	return nil, fmt.Errorf("%w: credential helper has no token", ErrNotApplicable)
+}
+
+// parseExpiresAt parses the expires_at field of a HelperResponse, which is
+// either an RFC 3339 time or a number of seconds since the epoch. It returns
+// the zero time if the field is missing.
+func parseExpiresAt(value json.RawMessage) (time.Time, error) {
+	if len(value) == 0 || string(value) == "null" {
+		return time.Time{}, nil
+	}
+
+	var secs int64
+	if err := json.Unmarshal(value, &secs); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	var when time.Time
+	if err := json.Unmarshal(value, &when); err != nil {
+		return time.Time{}, fmt.Errorf("expires_at is not a time: %s", value)
+	}
+	return when, nil
+}
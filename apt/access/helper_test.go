@@ -0,0 +1,194 @@
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/exec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHelperResponse(t *testing.T) {
+	now := time.Unix(1554076800, 0)
+
+	tests := []struct {
+		name          string
+		output        string
+		expected      Token
+		notApplicable bool
+		errors        bool
+	}{
+		{
+			name:     "Service Token",
+			output:   `{"client_id": "id.access", "client_secret": "secret"}`,
+			expected: &ServiceToken{ID: "id.access", Secret: "secret"},
+		},
+		{
+			name:     "JWT",
+			output:   `{"jwt": "a.b.c"}` + "\n",
+			expected: &UserToken{JWT: "a.b.c"},
+		},
+		{
+			name:     "JWT Expiry Seconds",
+			output:   `{"jwt": "a.b.c", "expires_at": 1554080400}`,
+			expected: &UserToken{JWT: "a.b.c", Expires: time.Unix(1554080400, 0)},
+		},
+		{
+			name:     "JWT Expiry Time",
+			output:   `{"jwt": "a.b.c", "expires_at": "2019-04-01T01:00:00Z"}`,
+			expected: &UserToken{JWT: "a.b.c", Expires: time.Date(2019, 4, 1, 1, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "Expired JWT",
+			output: `{"jwt": "a.b.c", "expires_at": 1554076800}`,
+			errors: true,
+		},
+		{
+			name:   "Bad Expiry",
+			output: `{"jwt": "a.b.c", "expires_at": "tomorrow"}`,
+			errors: true,
+		},
+		{
+			name:   "Missing Secret",
+			output: `{"client_id": "id.access"}`,
+			errors: true,
+		},
+		{
+			name:   "Not JSON",
+			output: "id.access\nsecret\n",
+			errors: true,
+		},
+		{
+			name:          "Empty",
+			output:        "\n",
+			notApplicable: true,
+		},
+		{
+			name:          "Empty Object",
+			output:        "{}",
+			notApplicable: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := ParseHelperResponse([]byte(test.output), now)
+			switch {
+			case test.notApplicable:
+				assert.True(t, errors.Is(err, ErrNotApplicable), "unexpected error %v", err)
+			case test.errors:
+				assert.Error(t, err)
+				assert.False(t, errors.Is(err, ErrNotApplicable))
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, token)
+			}
+		})
+	}
+}
+
+func TestHelperProvider(t *testing.T) {
+	uri, err := url.Parse("https://apt.example.com/debian/pkg.deb")
+	require.NoError(t, err)
+
+	fb := exec.NewMockBuilder("TestHelperProcess")
+	exec.Builder = fb
+
+	tests := []struct {
+		name          string
+		command       string
+		args          []string
+		entry         exec.MockEntry
+		expected      Token
+		timeout       time.Duration
+		notApplicable bool
+		errmsg        string
+	}{
+		{
+			name:     "Service Token",
+			command:  "vault-helper",
+			args:     []string{"--role", "apt"},
+			entry:    exec.MockEntry{Output: `{"client_id": "id", "client_secret": "secret"}`},
+			expected: &ServiceToken{ID: "id", Secret: "secret"},
+		},
+		{
+			name:     "JWT",
+			command:  "vault-helper",
+			entry:    exec.MockEntry{Output: `{"jwt": "a.b.c"}`},
+			expected: &UserToken{JWT: "a.b.c"},
+		},
+		{
+			name:     "Path With Spaces",
+			command:  "/opt/Vault Tools/vault-helper",
+			entry:    exec.MockEntry{Output: `{"jwt": "a.b.c"}`},
+			expected: &UserToken{JWT: "a.b.c"},
+		},
+		{
+			name:          "No Token",
+			command:       "vault-helper",
+			entry:         exec.MockEntry{},
+			notApplicable: true,
+		},
+		{
+			name:          "No Helper",
+			command:       " ",
+			notApplicable: true,
+		},
+		{
+			name:    "Failure",
+			command: "vault-helper",
+			entry:   exec.MockEntry{ExitCode: 2, Stderr: "permission denied"},
+			errmsg:  "credential helper vault-helper failed: exit status 2: permission denied",
+		},
+		{
+			name:    "Bad Output",
+			command: "vault-helper",
+			entry:   exec.MockEntry{Output: "secret"},
+			errmsg:  "credential helper vault-helper: invalid response",
+		},
+		{
+			name:    "Timeout",
+			command: "vault-helper",
+			entry:   exec.MockEntry{Sleep: 5 * time.Second},
+			timeout: 50 * time.Millisecond,
+			errmsg:  "credential helper vault-helper timed out after 50ms",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fb.Reset(test.entry)
+			provider := &HelperProvider{Command: test.command, Args: test.args, Timeout: test.timeout}
+
+			token, err := provider.Token(context.Background(), uri)
+			if len(fb.Calls) > 0 {
+				assert.Equal(t, test.command, fb.Calls[0].Cmd)
+				assert.Equal(t, test.args, fb.Calls[0].Args)
+			}
+			switch {
+			case test.notApplicable:
+				assert.True(t, errors.Is(err, ErrNotApplicable), "unexpected error %v", err)
+			case test.errmsg != "":
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.errmsg)
+				assert.False(t, errors.Is(err, ErrNotApplicable))
+				var timeout *HelperTimeoutError
+				assert.Equal(t, test.timeout != 0, errors.As(err, &timeout))
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, token)
+			}
+		})
+	}
+}
+
+func TestHelperRequest(t *testing.T) {
+	data, err := json.Marshal(&HelperRequest{Host: "apt.example.com:8443"})
+	require.NoError(t, err)
+	assert.Equal(t, `{"host":"apt.example.com:8443"}`, string(data))
+}
@@ -0,0 +1,269 @@
+package access
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Claims holds the JWT claims used by the method.
+type Claims struct {
+	// Expires is the 'exp' claim, in seconds since the epoch.
+	Expires int64 `json:"exp"`
+
+	// NotBefore is the 'nbf' claim, in seconds since the epoch.
+	NotBefore int64 `json:"nbf"`
+
+	// Issuer is the 'iss' claim. Access issues tokens from the team domain,
+	// e.g. https://example.cloudflareaccess.com.
+	Issuer string `json:"iss"`
+
+	// Audience is the 'aud' claim, which holds the audience tags of the
+	// Access applications the token is for.
+	Audience Audience `json:"aud"`
+
+	// Email is the 'email' claim, which Access sets to the email address of
+	// the user.
+	Email string `json:"email"`
+
+	// Subject is the 'sub' claim, which identifies the user.
+	Subject string `json:"sub"`
+}
+
+// Audience is the 'aud' claim of a JWT, which may be a single string or a
+// list of them.
+type Audience []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("'aud' is neither a string nor a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences.
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtHeader holds the JWT header fields used to check the signature.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtParts holds a decoded JWT.
+type jwtParts struct {
+	header    jwtHeader
+	claims    Claims
+	signed    string
+	signature []byte
+}
+
+// splitJWT decodes the header, claims and signature of a JWT.
+//
+// The signature of the token is not checked.
+func splitJWT(jwt string) (*jwtParts, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT: expected three segments")
+	}
+
+	var p jwtParts
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	if err := json.Unmarshal(payload, &p.claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %v", err)
+	}
+
+	// Only the signature check needs the header, so tokens with a header
+	// which can't be decoded are left for it to reject
+	if header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "=")); err == nil {
+		_ = json.Unmarshal(header, &p.header)
+	}
+	p.signature, _ = base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	p.signed = parts[0] + "." + parts[1]
+	return &p, nil
+}
+
+// ParseClaims decodes the claims of a JWT.
+//
+// The signature of the token is not checked.
+func ParseClaims(jwt string) (*Claims, error) {
+	p, err := splitJWT(jwt)
+	if err != nil {
+		return nil, err
+	}
+	return &p.claims, nil
+}
+
+// ExpiresAt returns the expiry time of the token, or the zero time if the
+// token has no 'exp' claim.
+func (c *Claims) ExpiresAt() time.Time {
+	if c.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.Expires, 0)
+}
+
+// checkTimes returns an error if the token expires within expirySkew of now,
+// or isn't valid until more than expirySkew after now, which allows for the
+// clock of this machine being a little behind that of Access.
+//
+// Tokens without an expiry time are rejected, as there is no way to tell
+// whether they are still valid.
+func (c *Claims) checkTimes(now time.Time) error {
+	expires := c.ExpiresAt()
+	if expires.IsZero() {
+		return errors.New("JWT has no expiry time")
+	}
+	if !expires.After(now.Add(expirySkew)) {
+		return fmt.Errorf("JWT expired at %s", expires.UTC().Format(time.RFC3339))
+	}
+
+	if c.NotBefore != 0 {
+		notBefore := time.Unix(c.NotBefore, 0)
+		if notBefore.After(now.Add(expirySkew)) {
+			return fmt.Errorf("JWT is not valid until %s", notBefore.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// checkUserJWT returns an error unless the JWT is well-formed, doesn't expire
+// within expirySkew of now and is already valid. See Claims.checkTimes.
+func checkUserJWT(jwt string, now time.Time) error {
+	claims, err := ParseClaims(jwt)
+	if err != nil {
+		return err
+	}
+	return claims.checkTimes(now)
+}
+
+// ValidationOptions controls how user tokens are checked before they are
+// used. Their expiry and not-before times are always checked, and the other
+// checks are only made if they are configured.
+type ValidationOptions struct {
+	// TeamDomain is the Access team domain which must have issued the
+	// tokens, e.g. example.cloudflareaccess.com. If it is empty, the issuer
+	// isn't checked.
+	TeamDomain string
+
+	// Audience is the audience tag of the Access application the tokens
+	// must be for. If it is empty, the audience isn't checked.
+	Audience string
+
+	// VerifySignature checks the signature of the tokens against the
+	// signing keys published by TeamDomain, which must be set.
+	VerifySignature bool
+
+	// Keys caches the signing keys. If it is nil, the keys are fetched for
+	// every token.
+	Keys *KeyCache
+
+	// Client is used to fetch the signing keys. If it is nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// enabled reports whether any checks beyond those of the token times are
+// configured.
+func (o *ValidationOptions) enabled() bool {
+	return o.TeamDomain != "" || o.Audience != "" || o.VerifySignature
+}
+
+// InvalidTokenError is returned by ValidateUserJWT for a token which is
+// malformed, expired, or not from the configured team or for the configured
+// application.
+type InvalidTokenError struct {
+	Reason string
+}
+
+func (e *InvalidTokenError) Error() string {
+	return "invalid user token: " + e.Reason
+}
+
+// ValidateUserJWT checks a user token before it is sent to Access, so that
+// stale tokens, and tokens for other teams or applications, are never sent.
+//
+// An InvalidTokenError is returned for a token which fails the checks, while
+// other errors, such as failing to fetch the signing keys, mean the token
+// couldn't be checked.
+func ValidateUserJWT(ctx context.Context, jwt string, opts *ValidationOptions) error {
+	return validateUserJWT(ctx, jwt, opts, time.Now())
+}
+
+func validateUserJWT(ctx context.Context, jwt string, opts *ValidationOptions, now time.Time) error {
+	p, err := splitJWT(jwt)
+	if err != nil {
+		return &InvalidTokenError{Reason: err.Error()}
+	}
+	if err := p.claims.checkTimes(now); err != nil {
+		return &InvalidTokenError{Reason: err.Error()}
+	}
+
+	if opts.TeamDomain != "" && !strings.EqualFold(strings.TrimSuffix(p.claims.Issuer, "/"), teamURL(opts.TeamDomain)) {
+		return &InvalidTokenError{Reason: fmt.Sprintf("JWT was issued by %q, not %s", p.claims.Issuer, opts.TeamDomain)}
+	}
+	if opts.Audience != "" && !p.claims.Audience.Contains(opts.Audience) {
+		return &InvalidTokenError{Reason: fmt.Sprintf("JWT is not for audience %s", opts.Audience)}
+	}
+
+	if !opts.VerifySignature {
+		return nil
+	}
+	if opts.TeamDomain == "" {
+		return errors.New("the team domain is needed to verify the signature of user tokens")
+	}
+	if p.header.Algorithm != "RS256" {
+		return &InvalidTokenError{Reason: fmt.Sprintf("JWT is signed with %q, not RS256", p.header.Algorithm)}
+	}
+
+	keys := opts.Keys
+	if keys == nil {
+		keys = NewKeyCache("")
+	}
+	key, err := keys.Key(ctx, opts.Client, opts.TeamDomain, p.header.KeyID)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return &InvalidTokenError{Reason: fmt.Sprintf("JWT is signed with unknown key %q", p.header.KeyID)}
+	}
+
+	digest := sha256.Sum256([]byte(p.signed))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], p.signature); err != nil {
+		return &InvalidTokenError{Reason: "JWT signature is not valid"}
+	}
+	return nil
+}
+
+// teamURL returns the URL of the team domain, which is the issuer of its
+// tokens.
+func teamURL(teamDomain string) string {
+	return "https://" + strings.TrimSuffix(teamDomain, "/")
+}
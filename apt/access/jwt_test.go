@@ -0,0 +1,184 @@
+package access
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeJWT builds an unsigned JWT with the given claims.
+func makeJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestParseClaims(t *testing.T) {
+	claims, err := ParseClaims(makeJWT(`{"exp":1554076800}`))
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1554076800, 0), claims.ExpiresAt())
+
+	claims, err = ParseClaims(makeJWT(`{}`))
+	require.NoError(t, err)
+	assert.True(t, claims.ExpiresAt().IsZero())
+
+	_, err = ParseClaims("token-1a24fd")
+	assert.Error(t, err)
+	_, err = ParseClaims("a.!!!.c")
+	assert.Error(t, err)
+	_, err = ParseClaims("a." + base64.RawURLEncoding.EncodeToString([]byte("nope")) + ".c")
+	assert.Error(t, err)
+}
+
+func TestCheckUserJWT(t *testing.T) {
+	now := time.Unix(1554076800, 0)
+	assert.NoError(t, checkUserJWT(makeJWT(`{"exp":1554080400}`), now))
+	assert.Error(t, checkUserJWT(makeJWT(`{"exp":1554076800}`), now))
+	assert.Error(t, checkUserJWT(makeJWT(`{"exp":1554076801}`), now), "expires within the skew")
+	assert.Error(t, checkUserJWT(makeJWT(`{"sub":"user"}`), now))
+	assert.Error(t, checkUserJWT("token-1a24fd", now))
+}
+
+func TestAudience(t *testing.T) {
+	var claims Claims
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":"abc"}`), &claims))
+	assert.Equal(t, Audience{"abc"}, claims.Audience)
+	assert.True(t, claims.Audience.Contains("abc"))
+	assert.False(t, claims.Audience.Contains("def"))
+
+	require.NoError(t, json.Unmarshal([]byte(`{"aud":["abc","def"]}`), &claims))
+	assert.Equal(t, Audience{"abc", "def"}, claims.Audience)
+	assert.True(t, claims.Audience.Contains("def"))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"aud":1}`), &claims))
+}
+
+func TestValidateUserJWT(t *testing.T) {
+	key1, key2 := signingKey(t, 0), signingKey(t, 1)
+	srv := newCertsServer(map[string]*rsa.PublicKey{"key1": &key1.PublicKey})
+	defer srv.Close()
+
+	now := time.Unix(1554076800, 0)
+	team := srv.TeamDomain()
+	claims := func(extra string) string {
+		return fmt.Sprintf(`{"exp":%d,"iss":"https://%s","aud":["aud-1"]%s}`, now.Add(time.Hour).Unix(), team, extra)
+	}
+	valid := signJWT(t, key1, "key1", claims(""))
+	parts := strings.Split(valid, ".")
+
+	full := ValidationOptions{TeamDomain: team, Audience: "aud-1", VerifySignature: true, Client: srv.Client()}
+	tests := []struct {
+		name    string
+		jwt     string
+		opts    ValidationOptions
+		invalid bool
+		errors  bool
+	}{
+		{
+			name: "Valid",
+			jwt:  valid,
+			opts: full,
+		},
+		{
+			name: "Times Only",
+			jwt:  makeJWT(fmt.Sprintf(`{"exp":%d}`, now.Add(time.Hour).Unix())),
+		},
+		{
+			name:    "Malformed",
+			jwt:     "token-1a24fd",
+			invalid: true,
+		},
+		{
+			name:    "Expired",
+			jwt:     signJWT(t, key1, "key1", fmt.Sprintf(`{"exp":%d}`, now.Unix())),
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name:    "Not Yet Valid",
+			jwt:     signJWT(t, key1, "key1", claims(fmt.Sprintf(`,"nbf":%d`, now.Add(10*time.Minute).Unix()))),
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name: "Valid Within Skew",
+			jwt:  signJWT(t, key1, "key1", claims(fmt.Sprintf(`,"nbf":%d`, now.Add(time.Second).Unix()))),
+			opts: full,
+		},
+		{
+			name:    "Other Team",
+			jwt:     valid,
+			opts:    ValidationOptions{TeamDomain: "other.cloudflareaccess.com"},
+			invalid: true,
+		},
+		{
+			name: "Issuer With Slash",
+			jwt:  makeJWT(fmt.Sprintf(`{"exp":%d,"iss":"https://%s/"}`, now.Add(time.Hour).Unix(), team)),
+			opts: ValidationOptions{TeamDomain: strings.ToUpper(team)},
+		},
+		{
+			name:    "Other Application",
+			jwt:     valid,
+			opts:    ValidationOptions{Audience: "aud-2"},
+			invalid: true,
+		},
+		{
+			name:    "Unsigned",
+			jwt:     makeJWT(claims("")),
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name:    "Unknown Key",
+			jwt:     signJWT(t, key2, "key2", claims("")),
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name:    "Wrong Key",
+			jwt:     signJWT(t, key2, "key1", claims("")),
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name:    "Modified Claims",
+			jwt:     parts[0] + "." + strings.Split(makeJWT(claims(`,"email":"x"`)), ".")[1] + "." + parts[2],
+			opts:    full,
+			invalid: true,
+		},
+		{
+			name:   "No Team Domain",
+			jwt:    valid,
+			opts:   ValidationOptions{VerifySignature: true},
+			errors: true,
+		},
+		{
+			name:   "Keys Unavailable",
+			jwt:    valid,
+			opts:   ValidationOptions{TeamDomain: team, VerifySignature: true, Client: &http.Client{}},
+			errors: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			opts.Keys = NewKeyCache("")
+			err := validateUserJWT(context.Background(), test.jwt, &opts, now)
+
+			var invalid *InvalidTokenError
+			assert.Equal(t, test.invalid, errors.As(err, &invalid), "invalid token error: %v", err)
+			assert.Equal(t, test.invalid || test.errors, err != nil, "error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package access
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// certsPath is the path, under the team domain, of the JSON Web Key Set
+	// holding the keys Access signs tokens with.
+	certsPath = "/cdn-cgi/access/certs"
+
+	// keysMaxAge is how long signing keys are used before they are fetched
+	// again. Access rotates its keys every six weeks, and a token signed
+	// with a key which isn't cached makes the keys be fetched at once.
+	keysMaxAge = 24 * time.Hour
+
+	// maxCertsSize is the largest key set which is accepted.
+	maxCertsSize = 1024 * 1024
+)
+
+// KeyCache fetches the keys Access teams sign tokens with, and keeps them in
+// memory and, optionally, on disk, so that they aren't fetched for every run.
+//
+// If several goroutines need the keys of the same team at once, only one of
+// them fetches the keys and the others wait for its result.
+type KeyCache struct {
+	// Dir is the directory key sets are cached in, as ${TEAM_DOMAIN}-certs.json.
+	// If it is empty, they are only cached in memory.
+	Dir string
+
+	mu      sync.Mutex
+	sets    map[string]*keySet
+	fetches map[string]*keyFetch
+	now     func() time.Time
+}
+
+// keySet is the signing keys of a team, by key ID.
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// keyFetch is a fetch of the keys of a team, which is closed once it is done.
+type keyFetch struct {
+	done chan struct{}
+	set  *keySet
+	err  error
+}
+
+// NewKeyCache creates an empty KeyCache, which caches key sets in dir, if it
+// isn't empty.
+func NewKeyCache(dir string) *KeyCache {
+	return &KeyCache{
+		Dir:     dir,
+		sets:    make(map[string]*keySet),
+		fetches: make(map[string]*keyFetch),
+		now:     time.Now,
+	}
+}
+
+// Key returns the signing key of the team with the given key ID, or nil if
+// the team has no such key, fetching the team's keys with client if they
+// aren't cached, have expired, or don't include the key.
+//
+// If the keys can't be fetched, keys which have expired are still used.
+func (kc *KeyCache) Key(ctx context.Context, client *http.Client, teamDomain, kid string) (*rsa.PublicKey, error) {
+	teamDomain = strings.ToLower(strings.TrimSuffix(teamDomain, "/"))
+
+	kc.mu.Lock()
+	set := kc.sets[teamDomain]
+	kc.mu.Unlock()
+	if set == nil {
+		set = kc.load(teamDomain)
+	}
+	if set != nil && set.keys[kid] != nil && kc.now().Sub(set.fetched) < keysMaxAge {
+		return set.keys[kid], nil
+	}
+
+	kc.mu.Lock()
+	fetch, ok := kc.fetches[teamDomain]
+	if !ok {
+		fetch = &keyFetch{done: make(chan struct{})}
+		kc.fetches[teamDomain] = fetch
+	}
+	kc.mu.Unlock()
+	if !ok {
+		kc.fetch(ctx, client, teamDomain, fetch)
+	}
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if fetch.err != nil {
+		if set != nil && set.keys[kid] != nil {
+			return set.keys[kid], nil
+		}
+		return nil, fetch.err
+	}
+	return fetch.set.keys[kid], nil
+}
+
+// fetch fetches the keys of a team for the given fetch, and caches them if
+// they are valid. The cache isn't locked while the keys are fetched.
+func (kc *KeyCache) fetch(ctx context.Context, client *http.Client, teamDomain string, fetch *keyFetch) {
+	defer close(fetch.done)
+
+	data, err := fetchCerts(ctx, client, teamDomain)
+	if err == nil {
+		if fetch.set, err = parseKeySet(data); err != nil {
+			err = fmt.Errorf("bad signing keys from %s: %v", teamDomain, err)
+		}
+	}
+	fetch.err = err
+
+	kc.mu.Lock()
+	delete(kc.fetches, teamDomain)
+	if err == nil {
+		fetch.set.fetched = kc.now()
+		kc.sets[teamDomain] = fetch.set
+	}
+	kc.mu.Unlock()
+
+	if err == nil {
+		kc.store(teamDomain, data)
+	}
+}
+
+// load reads the key set of a team cached on disk, if there is one. A
+// cached set which can't be read is ignored.
+func (kc *KeyCache) load(teamDomain string) *keySet {
+	if kc.Dir == "" {
+		return nil
+	}
+
+	filename := filepath.Join(kc.Dir, teamDomain+"-certs.json")
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil
+	}
+
+	set, err := parseKeySet(data)
+	if err != nil {
+		return nil
+	}
+	set.fetched = info.ModTime()
+
+	// Keep the keys if they were fetched while the file was read
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if cached := kc.sets[teamDomain]; cached != nil {
+		return cached
+	}
+	kc.sets[teamDomain] = set
+	return set
+}
+
+// store caches the key set of a team on disk. The keys are public, so
+// failing to cache them only means they are fetched again next time.
+//
+// The key set is written to a temporary file which is renamed into place, so
+// a concurrent reader never sees part of it.
+func (kc *KeyCache) store(teamDomain string, data []byte) {
+	if kc.Dir == "" {
+		return
+	}
+	if err := os.MkdirAll(kc.Dir, 0755); err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(kc.Dir, "."+teamDomain+"-certs")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return
+	}
+	_ = os.Chmod(tmp.Name(), 0644)
+	_ = os.Rename(tmp.Name(), filepath.Join(kc.Dir, teamDomain+"-certs.json"))
+}
+
+// fetchCerts fetches the JSON Web Key Set of a team.
+func fetchCerts(ctx context.Context, client *http.Client, teamDomain string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", teamURL(teamDomain)+certsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch signing keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch signing keys from %s: %s", teamDomain, resp.Status)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxCertsSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch signing keys from %s: %v", teamDomain, err)
+	}
+	return data, nil
+}
+
+// jsonWebKey is a key in a JSON Web Key Set. Only the fields of RSA keys are
+// used.
+type jsonWebKey struct {
+	KeyID    string `json:"kid"`
+	KeyType  string `json:"kty"`
+	Modulus  string `json:"n"`
+	Exponent string `json:"e"`
+}
+
+// parseKeySet parses the RSA keys of a JSON Web Key Set. Keys of other types
+// are skipped.
+func parseKeySet(data []byte) (*keySet, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	set := &keySet{keys: make(map[string]*rsa.PublicKey)}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus for key %q: %v", jwk.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad exponent for key %q", jwk.KeyID)
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		set.keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+
+	if len(set.keys) == 0 {
+		return nil, errors.New("no RSA keys")
+	}
+	return set, nil
+}
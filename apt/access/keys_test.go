@@ -0,0 +1,289 @@
+package access
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	signingKeysOnce sync.Once
+	signingKeys     [2]*rsa.PrivateKey
+)
+
+// signingKey returns one of two RSA keys generated for the tests.
+func signingKey(t *testing.T, i int) *rsa.PrivateKey {
+	signingKeysOnce.Do(func() {
+		for j := range signingKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			require.NoError(t, err)
+			signingKeys[j] = key
+		}
+	})
+	return signingKeys[i]
+}
+
+// signJWT returns a JWT with the claims, signed with RS256 by the key with
+// the given key ID.
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid, claims string) string {
+	enc := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString([]byte(claims))
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// certsServer is a stand-in for the signing keys of an Access team, served
+// at /cdn-cgi/access/certs.
+type certsServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	status  int
+	fetches int
+
+	// block, if it isn't nil, holds up requests until it is closed.
+	block chan struct{}
+}
+
+func newCertsServer(keys map[string]*rsa.PublicKey) *certsServer {
+	cs := &certsServer{keys: keys, status: http.StatusOK}
+	cs.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cs.mu.Lock()
+		block := cs.block
+		cs.mu.Unlock()
+		if block != nil {
+			<-block
+		}
+
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		if r.URL.Path != certsPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cs.fetches++
+		if cs.status != http.StatusOK {
+			w.WriteHeader(cs.status)
+			return
+		}
+
+		enc := base64.RawURLEncoding
+		jwks := map[string][]map[string]string{
+			"keys": {{"kid": "ec", "kty": "EC", "crv": "P-256"}},
+		}
+		for kid, key := range cs.keys {
+			jwks["keys"] = append(jwks["keys"], map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   enc.EncodeToString(key.N.Bytes()),
+				"e":   enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+
+	// Clients which don't trust the test certificate are expected
+	cs.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	cs.StartTLS()
+	return cs
+}
+
+// TeamDomain returns the host the server is listening on, which stands in
+// for the team domain.
+func (cs *certsServer) TeamDomain() string {
+	return strings.TrimPrefix(cs.URL, "https://")
+}
+
+func (cs *certsServer) set(keys map[string]*rsa.PublicKey, status int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keys, cs.status = keys, status
+}
+
+func (cs *certsServer) Fetches() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.fetches
+}
+
+func TestKeyCache(t *testing.T) {
+	key1, key2 := &signingKey(t, 0).PublicKey, &signingKey(t, 1).PublicKey
+	srv := newCertsServer(map[string]*rsa.PublicKey{"key1": key1})
+	defer srv.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	cache := NewKeyCache("")
+	cache.now = func() time.Time { return now }
+
+	key, err := cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.Equal(t, 1, srv.Fetches())
+
+	// Cached keys are used until they expire
+	key, err = cache.Key(ctx, srv.Client(), strings.ToUpper(srv.TeamDomain()), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.Equal(t, 1, srv.Fetches())
+
+	// A key which isn't cached makes the keys be fetched again
+	srv.set(map[string]*rsa.PublicKey{"key1": key1, "key2": key2}, http.StatusOK)
+	key, err = cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key2")
+	require.NoError(t, err)
+	assert.Equal(t, key2, key)
+	assert.Equal(t, 2, srv.Fetches())
+
+	key, err = cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key3")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Equal(t, 3, srv.Fetches())
+
+	// Expired keys are fetched again, but still used if that fails
+	now = now.Add(keysMaxAge)
+	srv.set(nil, http.StatusInternalServerError)
+	key, err = cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.Equal(t, 4, srv.Fetches())
+
+	_, err = cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key3")
+	assert.Error(t, err)
+}
+
+func TestKeyCacheConcurrent(t *testing.T) {
+	key1 := &signingKey(t, 0).PublicKey
+	slow := newCertsServer(map[string]*rsa.PublicKey{"key1": key1})
+	defer slow.Close()
+	fast := newCertsServer(map[string]*rsa.PublicKey{"key1": key1})
+	defer fast.Close()
+
+	ctx := context.Background()
+	cache := NewKeyCache("")
+	_, err := cache.Key(ctx, fast.Client(), fast.TeamDomain(), "key1")
+	require.NoError(t, err)
+
+	block := make(chan struct{})
+	slow.mu.Lock()
+	slow.block = block
+	slow.mu.Unlock()
+
+	// Only one of the goroutines fetches the keys of a team
+	var wg sync.WaitGroup
+	keys := make([]*rsa.PublicKey, 5)
+	errs := make([]error, len(keys))
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = cache.Key(ctx, slow.Client(), slow.TeamDomain(), "key1")
+		}(i)
+	}
+
+	for inFlight := false; !inFlight; time.Sleep(time.Millisecond) {
+		cache.mu.Lock()
+		inFlight = cache.fetches[slow.TeamDomain()] != nil
+		cache.mu.Unlock()
+	}
+
+	// The keys of other teams can be used while they are fetched
+	key, err := cache.Key(ctx, fast.Client(), fast.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+
+	close(block)
+	wg.Wait()
+	for i := range keys {
+		require.NoError(t, errs[i])
+		assert.Equal(t, key1, keys[i])
+	}
+	assert.Equal(t, 1, slow.Fetches())
+	assert.Equal(t, 1, fast.Fetches())
+}
+
+func TestKeyCacheDir(t *testing.T) {
+	key1 := &signingKey(t, 0).PublicKey
+	srv := newCertsServer(map[string]*rsa.PublicKey{"key1": key1})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	key, err := NewKeyCache(dir).Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.FileExists(t, filepath.Join(dir, srv.TeamDomain()+"-certs.json"))
+
+	// Another run uses the keys cached on disk
+	key, err = NewKeyCache(dir).Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.Equal(t, 1, srv.Fetches())
+
+	// Until they expire
+	cache := NewKeyCache(dir)
+	cache.now = func() time.Time { return time.Now().Add(keysMaxAge) }
+	_, err = cache.Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.Fetches())
+
+	// A cache which can't be parsed is ignored
+	filename := filepath.Join(dir, srv.TeamDomain()+"-certs.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0644))
+	key, err = NewKeyCache(dir).Key(ctx, srv.Client(), srv.TeamDomain(), "key1")
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	assert.Equal(t, 3, srv.Fetches())
+}
+
+func TestParseKeySet(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"Not JSON", `<html>`},
+		{"No Keys", `{"keys":[]}`},
+		{"No RSA Keys", `{"keys":[{"kid":"ec","kty":"EC"}]}`},
+		{"Bad Modulus", `{"keys":[{"kid":"a","kty":"RSA","n":"!!","e":"AQAB"}]}`},
+		{"Bad Exponent", `{"keys":[{"kid":"a","kty":"RSA","n":"AQAB","e":""}]}`},
+	}
+
+	for _, test := range tests {
+		_, err := parseKeySet([]byte(test.data))
+		assert.Error(t, err, test.name)
+	}
+
+	set, err := parseKeySet([]byte(`{"keys":[{"kid":"a","kty":"RSA","n":"AQAB","e":"AQAB"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 65537, set.keys["a"].E)
+	assert.Equal(t, int64(0x010001), set.keys["a"].N.Int64())
+}
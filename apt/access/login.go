@@ -0,0 +1,321 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// DefaultTransferURL is the token transfer service cloudflared uses to
+	// hand the token from the browser back to the command line.
+	DefaultTransferURL = "https://login.cloudflareaccess.org/"
+
+	// cliPath is the path of the Access endpoint which starts a command line
+	// login.
+	cliPath = "/cdn-cgi/access/cli"
+
+	// audHeader is the header Access sets to the audience tag of the
+	// application on requests it rejects.
+	audHeader = "CF-Access-Aud"
+
+	// servicePublicKeyHeader is the header the transfer service sets to the
+	// public key the token was encrypted with.
+	servicePublicKeyHeader = "Service-Public-Key"
+
+	// defaultPollInterval is how long to wait between requests to the
+	// transfer service while the user logs in.
+	defaultPollInterval = time.Second
+
+	// maxTransferSize is the largest response from the transfer service
+	// which is accepted.
+	maxTransferSize = 64 * 1024
+)
+
+// LoginOptions controls the native Access login flow.
+type LoginOptions struct {
+	// TransferURL is the base URL of the token transfer service. If it is
+	// empty, DefaultTransferURL is used.
+	TransferURL string
+
+	// Audience is the audience tag of the application. If it is empty, it is
+	// found by requesting the root of the application, which Access
+	// redirects to the login page for it.
+	Audience string
+
+	// TokenDir is the directory the token is stored in after logging in, as
+	// ${HOST}-token, the same as cloudflared, so that FindStoredToken finds
+	// it. If it is empty, the token is not stored.
+	TokenDir string
+
+	// Client is used to find the audience tag and to poll the transfer
+	// service. If it is nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Output is where the login URL is written for the user to open. If it
+	// is nil, the URL is discarded.
+	Output io.Writer
+
+	// PollInterval is how long to wait between polls of the transfer
+	// service. If it is 0, the service is polled every second.
+	PollInterval time.Duration
+}
+
+// LoginRequiredError is returned when the user would have to log in to get a
+// token, but Options.NonInteractive is set.
+type LoginRequiredError struct {
+	// AppURL is the root of the application. The login page itself is only
+	// known once Access has redirected a request to it, but opening the
+	// application in a browser is redirected there as well.
+	AppURL string
+}
+
+func (e *LoginRequiredError) Error() string {
+	return "logging in to Access is required, but the method is not interactive"
+}
+
+// newLoginRequiredError returns the LoginRequiredError for the application at
+// the given URI.
+func newLoginRequiredError(uri *url.URL) *LoginRequiredError {
+	app := url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: "/"}
+	return &LoginRequiredError{AppURL: app.String()}
+}
+
+// Login gets a user token for the given URI by running the Access command
+// line login flow, the same way cloudflared does, without using it.
+//
+// A NaCl box key pair is generated for the login, and the user is asked to
+// open the Access CLI login URL for the application with its public key. Once
+// the user has logged in, Access hands the token to the transfer service,
+// which encrypts it to the public key. The transfer service is polled under
+// the public key until the token is available or ctx is done.
+func Login(ctx context.Context, uri *url.URL, opts *LoginOptions) (*UserToken, error) {
+	if opts == nil {
+		opts = &LoginOptions{}
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	aud := opts.Audience
+	if aud == "" {
+		var err error
+		if aud, err = findAudience(ctx, client, uri); err != nil {
+			return nil, err
+		}
+	}
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate a login key: %v", err)
+	}
+	key := base64.URLEncoding.EncodeToString(public[:])
+
+	loginURL := LoginURL(uri, aud, key)
+	transferURL, err := buildTransferURL(opts.TransferURL, key)
+	if err != nil {
+		return nil, err
+	}
+
+	w := opts.Output
+	if w == nil {
+		w = ioutil.Discard
+	}
+	fmt.Fprintf(w, "Please open the following URL and log in with your Cloudflare account:\n\n%s\n\n", loginURL)
+
+	sealed, serviceKey, err := pollTransfer(ctx, client, transferURL, opts.PollInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := openTransfer(sealed, serviceKey, private)
+	if err != nil {
+		return nil, err
+	}
+
+	// The org token, which cloudflared uses to log in to other applications
+	// of the team without the browser, is also sent, but only the token for
+	// the application is used
+	var tokens struct {
+		AppToken string `json:"app_token"`
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("malformed response from the transfer service: %v", err)
+	}
+	if err := checkUserJWT(tokens.AppToken, time.Now()); err != nil {
+		return nil, fmt.Errorf("invalid token from the transfer service: %v", err)
+	}
+
+	if opts.TokenDir != "" {
+		if err := storeUserToken(opts.TokenDir, uri.Hostname(), tokens.AppToken); err != nil {
+			return nil, err
+		}
+	}
+	return &UserToken{JWT: tokens.AppToken}, nil
+}
+
+// LoginURL returns the URL the user opens to log in to the application with
+// the audience tag aud, which hands the token to the transfer service
+// encrypted to key, a base64-encoded public key.
+//
+// The URL is built the same way as by cloudflared, which asks for the org
+// token as well as the token for the application, and for the transfer to be
+// made by Access itself.
+func LoginURL(uri *url.URL, aud, key string) string {
+	app := url.URL{Scheme: uri.Scheme, Host: uri.Host}
+	query := url.Values{"aud": {aud}, "token": {key}}
+	app.RawQuery = query.Encode()
+
+	query.Set("redirect_url", app.String())
+	query.Set("send_org_token", "true")
+	query.Set("edge_token_transfer", "true")
+	login := url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: cliPath, RawQuery: query.Encode()}
+	return login.String()
+}
+
+// findAudience returns the audience tag of the application at the URI.
+//
+// Access redirects requests which aren't authenticated to the login page,
+// with the audience tag as its 'kid' parameter, or rejects them with the
+// audience tag in a header, so the root of the application is requested
+// without following redirects.
+func findAudience(ctx context.Context, client *http.Client, uri *url.URL) (string, error) {
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	app := url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: "/"}
+	req, err := http.NewRequest("HEAD", app.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := noRedirect.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to find the Access application at %s: %v", app.String(), err)
+	}
+	resp.Body.Close()
+
+	if loc, err := resp.Location(); err == nil && IsLoginURL(loc) {
+		if aud := loc.Query().Get("kid"); aud != "" {
+			return aud, nil
+		}
+	}
+	if aud := resp.Header.Get(audHeader); aud != "" {
+		return aud, nil
+	}
+	return "", fmt.Errorf("no Access application at %s", app.String())
+}
+
+// buildTransferURL returns the URL the token is fetched from once the user has
+// logged in.
+func buildTransferURL(base, key string) (string, error) {
+	if base == "" {
+		base = DefaultTransferURL
+	}
+
+	uri, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid transfer URL %q: %v", base, err)
+	}
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + "/transfer/" + key
+	return uri.String(), nil
+}
+
+// pollTransfer polls the transfer service until it returns the token, and
+// returns it along with the public key of the service.
+//
+// The transfer service returns an error status until the user has logged in.
+// Client errors mean the token isn't there yet, while server errors stop the
+// login.
+func pollTransfer(ctx context.Context, client *http.Client, transferURL string,
+	interval time.Duration) ([]byte, string, error) {
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+
+	for {
+		data, key, err := pollOnce(ctx, client, transferURL)
+		if err != nil || data != nil {
+			return data, key, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("timed out waiting for the Access login: %v", ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pollOnce makes a single request to the transfer service. It returns nil if
+// the token isn't available yet.
+func pollOnce(ctx context.Context, client *http.Client, transferURL string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", transferURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", fmt.Errorf("timed out waiting for the Access login: %v", ctx.Err())
+		}
+		return nil, "", fmt.Errorf("error polling the transfer service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, "", fmt.Errorf("error polling the transfer service: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTransferSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading the token from the transfer service: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, "", errors.New("empty response from the transfer service")
+	}
+	return data, resp.Header.Get(servicePublicKeyHeader), nil
+}
+
+// openTransfer decrypts a response from the transfer service, which is the
+// base64-encoded nonce followed by the NaCl box sealed with the private key
+// of the service and the public key of the login.
+func openTransfer(data []byte, serviceKey string, private *[32]byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sealed) < 24 {
+		return nil, errors.New("malformed response from the transfer service")
+	}
+
+	public, err := base64.URLEncoding.DecodeString(serviceKey)
+	if err != nil || len(public) != 32 {
+		return nil, errors.New("missing or malformed public key from the transfer service")
+	}
+
+	var nonce [24]byte
+	var peer [32]byte
+	copy(nonce[:], sealed)
+	copy(peer[:], public)
+	opened, ok := box.Open(nil, sealed[24:], &nonce, &peer, private)
+	if !ok {
+		return nil, errors.New("unable to decrypt the response from the transfer service")
+	}
+	return opened, nil
+}
@@ -0,0 +1,314 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// accessServer is a stand-in for an application behind Access, which
+// redirects requests to the login page of its team, and for the token
+// transfer service, which hands out the token encrypted to the key it is
+// polled under once it has been polled a number of times.
+type accessServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	heads  int
+	paths  []string
+	status int
+	token  string
+	after  int
+
+	// seal encrypts the response to the key of the login. It is replaced
+	// to send responses which can't be decrypted.
+	seal func(data []byte, key *[32]byte) ([]byte, string)
+}
+
+func newAccessServer(status int, token string, after int) *accessServer {
+	as := &accessServer{status: status, token: token, after: after, seal: sealTransfer}
+	as.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		as.mu.Lock()
+		defer as.mu.Unlock()
+
+		if r.Method == "HEAD" && r.URL.Path == "/" {
+			as.heads++
+			w.Header().Set("Location", "https://team.cloudflareaccess.com"+loginPath+"/"+r.Host+"?kid=aud-1")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/transfer/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		as.paths = append(as.paths, r.URL.Path)
+		if len(as.paths) <= as.after {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if as.status != http.StatusOK {
+			w.WriteHeader(as.status)
+			return
+		}
+
+		var key [32]byte
+		decoded, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/transfer/"))
+		if err != nil || len(decoded) != len(key) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		copy(key[:], decoded)
+
+		data, _ := json.Marshal(map[string]string{"app_token": as.token, "org_token": "org-token"})
+		body, serviceKey := as.seal(data, &key)
+		w.Header().Set(servicePublicKeyHeader, serviceKey)
+		fmt.Fprint(w, base64.StdEncoding.EncodeToString(body))
+	}))
+	return as
+}
+
+// sealTransfer encrypts data to key the way the transfer service does, with a
+// new key pair for the service, and returns the nonce followed by the box,
+// along with the public key of the service.
+func sealTransfer(data []byte, key *[32]byte) ([]byte, string) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	return box.Seal(nonce[:], data, &nonce, key, private), base64.URLEncoding.EncodeToString(public[:])
+}
+
+func (as *accessServer) Paths() []string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return append([]string(nil), as.paths...)
+}
+
+func (as *accessServer) Heads() int {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.heads
+}
+
+func TestLoginURL(t *testing.T) {
+	uri, err := url.Parse("https://apt.example.com/debian/dists/stable/InRelease")
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://apt.example.com/cdn-cgi/access/cli?aud=aud-1&edge_token_transfer=true&"+
+		"redirect_url=https%3A%2F%2Fapt.example.com%3Faud%3Daud-1%26token%3Dabc123&send_org_token=true&token=abc123",
+		LoginURL(uri, "aud-1", "abc123"))
+}
+
+func TestLogin(t *testing.T) {
+	jwt := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	srv := newAccessServer(http.StatusOK, jwt, 2)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-login-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uri, err := url.Parse(srv.URL + "/pkg.deb")
+	require.NoError(t, err)
+
+	var output strings.Builder
+	token, err := Login(context.Background(), uri, &LoginOptions{
+		TransferURL:  srv.URL,
+		TokenDir:     dir,
+		Client:       srv.Client(),
+		Output:       &output,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &UserToken{JWT: jwt}, token)
+
+	// The login URL is printed on its own line
+	var loginURL *url.URL
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.HasPrefix(line, "http://") {
+			loginURL, err = url.Parse(line)
+			require.NoError(t, err)
+		}
+	}
+	require.NotNil(t, loginURL)
+	assert.Equal(t, uri.Host, loginURL.Host)
+	assert.Equal(t, "/cdn-cgi/access/cli", loginURL.Path)
+	assert.Equal(t, "aud-1", loginURL.Query().Get("aud"))
+
+	// The transfer service is polled under the public key in the login URL
+	key := loginURL.Query().Get("token")
+	assert.Len(t, key, 44)
+	assert.Equal(t, []string{"/transfer/" + key, "/transfer/" + key, "/transfer/" + key}, srv.Paths())
+
+	filename := filepath.Join(dir, uri.Hostname()+"-token")
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, jwt, string(data))
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestLoginAudience(t *testing.T) {
+	jwt := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	srv := newAccessServer(http.StatusOK, jwt, 0)
+	defer srv.Close()
+
+	uri, err := url.Parse(srv.URL + "/pkg.deb")
+	require.NoError(t, err)
+
+	// A known audience tag is used without asking Access for it
+	var output strings.Builder
+	_, err = Login(context.Background(), uri, &LoginOptions{
+		TransferURL: srv.URL,
+		Audience:    "aud-2",
+		Client:      srv.Client(),
+		Output:      &output,
+	})
+	require.NoError(t, err)
+	assert.Contains(t, output.String(), "aud=aud-2")
+	assert.Equal(t, 0, srv.Heads())
+
+	// Access may reject the request with the audience tag in a header
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(audHeader, "aud-3")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer app.Close()
+
+	appURI, err := url.Parse(app.URL + "/pkg.deb")
+	require.NoError(t, err)
+	aud, err := findAudience(context.Background(), app.Client(), appURI)
+	require.NoError(t, err)
+	assert.Equal(t, "aud-3", aud)
+
+	// A host which isn't behind Access has no audience tag
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	plainURI, err := url.Parse(plain.URL + "/pkg.deb")
+	require.NoError(t, err)
+	_, err = Login(context.Background(), plainURI, &LoginOptions{TransferURL: srv.URL, Client: plain.Client()})
+	assert.Error(t, err)
+	assert.Len(t, srv.Paths(), 1)
+}
+
+func TestLoginErrors(t *testing.T) {
+	otherKey, _, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	valid := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	tests := []struct {
+		name   string
+		status int
+		token  string
+		after  int
+		seal   func(data []byte, key *[32]byte) ([]byte, string)
+	}{
+		{name: "Server Error", status: http.StatusBadGateway, token: valid},
+		{name: "Bad Token", status: http.StatusOK, token: "Unable to find token"},
+		{name: "Expired Token", status: http.StatusOK, token: makeJWT(`{"exp":1}`)},
+		{name: "Timeout", status: http.StatusOK, token: valid, after: 1000},
+		{
+			name:   "Not Encrypted",
+			status: http.StatusOK,
+			token:  valid,
+			seal: func(data []byte, key *[32]byte) ([]byte, string) {
+				_, serviceKey := sealTransfer(data, key)
+				return data, serviceKey
+			},
+		},
+		{
+			name:   "Other Key",
+			status: http.StatusOK,
+			token:  valid,
+			seal: func(data []byte, key *[32]byte) ([]byte, string) {
+				return sealTransfer(data, otherKey)
+			},
+		},
+		{
+			name:   "No Service Key",
+			status: http.StatusOK,
+			token:  valid,
+			seal: func(data []byte, key *[32]byte) ([]byte, string) {
+				sealed, _ := sealTransfer(data, key)
+				return sealed, ""
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newAccessServer(test.status, test.token, test.after)
+			defer srv.Close()
+			if test.seal != nil {
+				srv.mu.Lock()
+				srv.seal = test.seal
+				srv.mu.Unlock()
+			}
+
+			dir, err := ioutil.TempDir("", "cfd-login-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			uri, err := url.Parse(srv.URL + "/pkg.deb")
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			token, err := Login(ctx, uri, &LoginOptions{
+				TransferURL:  srv.URL,
+				TokenDir:     dir,
+				Client:       srv.Client(),
+				PollInterval: time.Millisecond,
+			})
+			assert.Error(t, err)
+			assert.Nil(t, token)
+
+			_, err = os.Stat(filepath.Join(dir, uri.Hostname()+"-token"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestGetTokenNativeLogin(t *testing.T) {
+	jwt := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	srv := newAccessServer(http.StatusOK, jwt, 0)
+	defer srv.Close()
+
+	uri, err := url.Parse(srv.URL + "/pkg.deb")
+	require.NoError(t, err)
+
+	token, err := GetToken(context.Background(), uri, &Options{
+		NativeLogin: true,
+		TransferURL: srv.URL,
+		Client:      srv.Client(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &UserToken{JWT: jwt}, token)
+	assert.Len(t, srv.Paths(), 1)
+}
@@ -0,0 +1,38 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// InsecureFileError is returned for a token file which other users could read
+// or replace, such as a world-readable file, or a symlink into a directory
+// anyone can write to.
+type InsecureFileError struct {
+	Filename string
+	Reason   string
+}
+
+func (e *InsecureFileError) Error() string {
+	return fmt.Sprintf("refusing to use insecure token file %s: %s", e.Filename, e.Reason)
+}
+
+// readTokenFile reads a file holding a token, after checking that no one but
+// root and the user running apt can read or replace it, as ssh does for its
+// keys.
+//
+// If allowInsecure is set, an insecure file is read anyway, and warn, if it
+// is set, is called with a warning about it.
+func readTokenFile(filename string, allowInsecure bool, warn func(string)) ([]byte, error) {
+	if err := checkTokenFile(filename); err != nil {
+		var insecure *InsecureFileError
+		if !errors.As(err, &insecure) || !allowInsecure {
+			return nil, err
+		}
+		if warn != nil {
+			warn(fmt.Sprintf("Using insecure token file %s: %s", insecure.Filename, insecure.Reason))
+		}
+	}
+	return ioutil.ReadFile(filename) // #nosec
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package access
+
+// checkTokenFile does nothing, as ownership and permissions can't be checked
+// the same way on this platform.
+func checkTokenFile(filename string) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package access
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// checkTokenFile returns an InsecureFileError if the file, or the directory
+// it is in, can be read or written by users other than root and the user
+// running apt. Symlinks are followed, and the file they point to is checked.
+func checkTokenFile(filename string) error {
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return err
+	}
+
+	insecure := func(format string, args ...interface{}) error {
+		reason := fmt.Sprintf(format, args...)
+		if resolved != filepath.Clean(filename) {
+			reason = fmt.Sprintf("%s (it is a symlink to %s)", reason, resolved)
+		}
+		return &InsecureFileError{Filename: filename, Reason: reason}
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return insecure("it is not a regular file")
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return insecure("its permissions %#o allow other users to access it", perm)
+	}
+	if uid := fileOwner(info); !trustedUID(uid) {
+		return insecure("it is owned by uid %d", uid)
+	}
+
+	dir := filepath.Dir(resolved)
+	info, err = os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return insecure("other users can write to %s", dir)
+	}
+	if uid := fileOwner(info); !trustedUID(uid) {
+		return insecure("%s is owned by uid %d", dir, uid)
+	}
+	return nil
+}
+
+// fileOwner returns the uid of the owner of a file.
+func fileOwner(info os.FileInfo) int {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid)
+	}
+	return -1
+}
+
+// trustedUIDs returns the users who may own token files: root, the user the
+// method runs as, and the user who ran apt with sudo, if any.
+func trustedUIDs() []int {
+	uids := []int{0, os.Getuid()}
+	if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+// trustedUID reports whether the user may own token files.
+func trustedUID(uid int) bool {
+	for _, trusted := range trustedUIDs() {
+		if uid == trusted {
+			return true
+		}
+	}
+	return false
+}
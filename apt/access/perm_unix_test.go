@@ -0,0 +1,121 @@
+//go:build unix
+
+package access
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-perm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	require.NoError(t, os.Mkdir(shared, 0700))
+	require.NoError(t, os.Chmod(shared, 0777))
+
+	write := func(name string, mode os.FileMode) string {
+		filename := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(filename, []byte("id\nsecret\n"), mode))
+		require.NoError(t, os.Chmod(filename, mode))
+		return filename
+	}
+	link := func(name, target string) string {
+		filename := filepath.Join(dir, name)
+		require.NoError(t, os.Symlink(target, filename))
+		return filename
+	}
+
+	private := write("private", 0600)
+	readOnly := write("read-only", 0400)
+	groupReadable := write("group-readable", 0640)
+	worldReadable := write("world-readable", 0644)
+	unshared := write("shared/token", 0600)
+
+	tests := []struct {
+		name     string
+		filename string
+		insecure bool
+	}{
+		{name: "Private", filename: private},
+		{name: "Read Only", filename: readOnly},
+		{name: "Group Readable", filename: groupReadable, insecure: true},
+		{name: "World Readable", filename: worldReadable, insecure: true},
+		{name: "Symlink", filename: link("link", private)},
+		{name: "Symlink To Insecure File", filename: link("insecure-link", worldReadable), insecure: true},
+		{name: "Writable Directory", filename: unshared, insecure: true},
+		{name: "Symlink To Writable Directory", filename: link("shared-link", unshared), insecure: true},
+		{name: "Directory", filename: shared, insecure: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkTokenFile(test.filename)
+			if !test.insecure {
+				assert.NoError(t, err)
+				return
+			}
+
+			var insecure *InsecureFileError
+			require.True(t, errors.As(err, &insecure), "unexpected error %v", err)
+			assert.Equal(t, test.filename, insecure.Filename)
+		})
+	}
+
+	err = checkTokenFile(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err), "unexpected error %v", err)
+}
+
+func TestCheckTokenFileOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can give files away")
+	}
+
+	dir, err := ioutil.TempDir("", "cfd-perm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("id\nsecret\n"), 0600))
+	require.NoError(t, checkTokenFile(filename))
+
+	t.Setenv("SUDO_UID", "")
+	require.NoError(t, os.Chown(filename, 65534, 65534))
+	var insecure *InsecureFileError
+	assert.True(t, errors.As(checkTokenFile(filename), &insecure))
+
+	// Files owned by the user who ran sudo are trusted
+	t.Setenv("SUDO_UID", "65534")
+	assert.NoError(t, checkTokenFile(filename))
+}
+
+func TestReadTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-perm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("id\nsecret\n"), 0600))
+	require.NoError(t, os.Chmod(filename, 0644))
+
+	var warnings []string
+	warn := func(msg string) { warnings = append(warnings, msg) }
+
+	_, err = readTokenFile(filename, false, warn)
+	assert.Error(t, err)
+	assert.Empty(t, warnings)
+
+	data, err := readTokenFile(filename, true, warn)
+	require.NoError(t, err)
+	assert.Equal(t, "id\nsecret\n", string(data))
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "Using insecure token file "+filename)
+}
@@ -0,0 +1,466 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	osexec "os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The names of the providers which can be listed in Options.Providers.
+const (
+	// ProviderEnv loads service tokens from environment variables.
+	ProviderEnv = "env"
+
+	// ProviderCredentials loads service tokens from systemd credentials.
+	ProviderCredentials = "systemd-credentials"
+
+	// ProviderServiceToken loads service tokens from Options.SystemTokenDir
+	// and Options.ServiceTokenDir.
+	ProviderServiceToken = "service-token"
+
+	// ProviderHelper runs Options.CredentialHelper.
+	ProviderHelper = "credential-helper"
+
+	// ProviderTokenDir uses valid user tokens stored in Options.TokenDir.
+	ProviderTokenDir = "token-dir"
+
+	// ProviderCloudflared gets user tokens by running cloudflared.
+	ProviderCloudflared = "cloudflared"
+
+	// ProviderLogin gets user tokens with the native login flow.
+	ProviderLogin = "login"
+)
+
+// ErrNotApplicable is returned by a TokenProvider which has no token for a
+// URI, e.g. because it isn't configured for the host. Providers may wrap it
+// to say why.
+//
+// A Chain moves on to the next provider when it gets ErrNotApplicable, while
+// any other error stops the chain.
+var ErrNotApplicable = errors.New("no token available")
+
+// TokenProvider is a source of tokens.
+type TokenProvider interface {
+	// Name identifies the provider, e.g. in logs.
+	Name() string
+
+	// Token returns a token for the URI, or an error wrapping
+	// ErrNotApplicable if the provider has no token for it.
+	Token(ctx context.Context, uri *url.URL) (Token, error)
+}
+
+// Chain is an ordered list of token providers.
+type Chain []TokenProvider
+
+// Token asks each provider in turn for a token for the URI, and returns the
+// first token found along with the name of the provider which produced it.
+//
+// Providers which aren't applicable are skipped. If a provider fails, the
+// error is returned without trying the remaining providers.
+func (c Chain) Token(ctx context.Context, uri *url.URL) (Token, string, error) {
+	lastErr := ErrNotApplicable
+	for _, provider := range c {
+		token, err := provider.Token(ctx, uri)
+		if errors.Is(err, ErrNotApplicable) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, provider.Name(), fmt.Errorf("%s: %w", provider.Name(), err)
+		}
+		return token, provider.Name(), nil
+	}
+	return nil, "", fmt.Errorf("no token for %s: %w", uri.Host, lastErr)
+}
+
+// DefaultProviders returns the providers used if Options.Providers is empty.
+//
+// Service tokens are preferred, from the environment, then systemd
+// credentials and then the service token directory. They are followed by the
+// credential helper and then user tokens which are already stored. Only then
+// is the user logged in, with cloudflared or, if nativeLogin is set, the
+// native login flow.
+func DefaultProviders(nativeLogin bool) []string {
+	login := ProviderCloudflared
+	if nativeLogin {
+		login = ProviderLogin
+	}
+	return []string{ProviderEnv, ProviderCredentials, ProviderServiceToken, ProviderHelper, ProviderTokenDir, login}
+}
+
+// IsProvider reports whether name is the name of a provider which can be
+// listed in Options.Providers.
+func IsProvider(name string) bool {
+	switch name {
+	case ProviderEnv, ProviderCredentials, ProviderServiceToken, ProviderHelper, ProviderTokenDir,
+		ProviderCloudflared, ProviderLogin:
+		return true
+	}
+	return false
+}
+
+// usesProvider reports whether the provider is one of those listed in
+// opts.Providers, or the default providers if none are listed.
+func usesProvider(opts *Options, name string) bool {
+	names := opts.Providers
+	if len(names) == 0 {
+		names = DefaultProviders(opts.NativeLogin)
+	}
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewChain builds the chain of providers listed in opts.Providers, or the
+// default providers if none are listed.
+func NewChain(opts *Options) (Chain, error) {
+	names := opts.Providers
+	if len(names) == 0 {
+		names = DefaultProviders(opts.NativeLogin)
+	}
+
+	w := opts.Output
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	chain := make(Chain, 0, len(names))
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case ProviderEnv:
+			chain = append(chain, &EnvProvider{})
+		case ProviderCredentials:
+			chain = append(chain, &CredentialsProvider{
+				Dir:           os.Getenv(EnvCredentialsDirectory),
+				AllowInsecure: opts.AllowInsecureTokens,
+				Warn:          opts.Warn,
+			})
+		case ProviderServiceToken:
+			chain = append(chain, &ServiceTokenProvider{
+				Dirs:          []string{opts.SystemTokenDir, opts.ServiceTokenDir},
+				AllowInsecure: opts.AllowInsecureTokens,
+				Warn:          opts.Warn,
+				AuthConf:      opts.AuthConf,
+			})
+		case ProviderHelper:
+			chain = append(chain, &HelperProvider{
+				Command: opts.CredentialHelper,
+				Args:    opts.CredentialHelperArgs,
+				Timeout: opts.CredentialHelperTimeout,
+			})
+		case ProviderTokenDir:
+			chain = append(chain, &StoredTokenProvider{
+				Dir:      opts.TokenDir,
+				Audience: opts.Validation.Audience,
+				Refresh:  opts.Refresh,
+			})
+		case ProviderCloudflared:
+			chain = append(chain, &CloudflaredProvider{
+				Path:           opts.Cloudflared,
+				Output:         w,
+				Refresh:        opts.Refresh,
+				NonInteractive: opts.NonInteractive,
+			})
+		case ProviderLogin:
+			chain = append(chain, &LoginProvider{
+				Options: LoginOptions{
+					TransferURL: opts.TransferURL,
+					Audience:    opts.Validation.Audience,
+					TokenDir:    opts.TokenDir,
+					Client:      opts.Client,
+					Output:      w,
+				},
+				NonInteractive: opts.NonInteractive,
+			})
+		default:
+			return nil, fmt.Errorf("unknown token provider %q", name)
+		}
+
+		if opts.Validation.enabled() {
+			chain[len(chain)-1] = &validatingProvider{TokenProvider: chain[len(chain)-1], opts: &opts.Validation}
+		}
+	}
+	return chain, nil
+}
+
+// validatingProvider checks the user tokens of another provider with
+// ValidateUserJWT. The provider isn't applicable if its token is invalid, so
+// that another source can be tried, but a token which can't be checked is an
+// error.
+type validatingProvider struct {
+	TokenProvider
+	opts *ValidationOptions
+}
+
+// Token implements the TokenProvider interface.
+func (p *validatingProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	token, err := p.TokenProvider.Token(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ut, ok := token.(*UserToken)
+	if !ok {
+		return token, nil
+	}
+
+	err = ValidateUserJWT(ctx, ut.JWT, p.opts)
+	var invalid *InvalidTokenError
+	if errors.As(err, &invalid) {
+		return nil, fmt.Errorf("%w: %v", ErrNotApplicable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// ServiceTokenProvider loads service tokens from a list of directories, which
+// are searched in order.
+//
+// In each directory, the auth.conf-style files named *.conf are searched
+// first, and the most specific entry for the URI is used; see AuthConfEntry.
+// Failing that, the service token is loaded from the file named
+// ${HOST}-Service-Token.
+type ServiceTokenProvider struct {
+	// Dirs are the directories to search. Empty entries are skipped.
+	Dirs []string
+
+	// AllowInsecure uses files which other users could read or replace,
+	// rather than refusing them. See LoadServiceToken.
+	AllowInsecure bool
+
+	// Warn, if set, is called with a warning for each service token file
+	// which can't be read, or is insecure but allowed.
+	Warn func(msg string)
+
+	// AuthConf caches the entries of the auth.conf-style files in Dirs. If
+	// it is nil, the files are loaded for every token.
+	AuthConf *AuthConfCache
+}
+
+// Name implements the TokenProvider interface.
+func (p *ServiceTokenProvider) Name() string {
+	return ProviderServiceToken
+}
+
+// Token implements the TokenProvider interface.
+//
+// The provider isn't applicable if there is no readable service token file
+// for the host, but a file which can't be parsed is an error.
+func (p *ServiceTokenProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	searched := false
+	for _, dir := range p.Dirs {
+		if dir == "" {
+			continue
+		}
+		searched = true
+
+		entries, err := loadAuthConf(p.AuthConf, dir, p.AllowInsecure, p.Warn)
+		if err != nil {
+			return nil, err
+		}
+		if entry := MatchAuthConf(entries, uri); entry != nil {
+			// The entries may be cached, and each token fetched must be
+			// distinct, so that TokenCache.Invalidate only drops the token
+			// which was rejected
+			token := *entry.Token
+			return &token, nil
+		}
+
+		filename := filepath.Join(dir, uri.Host+"-Service-Token")
+		token, err := loadServiceToken(filename, p.AllowInsecure, p.Warn)
+		if os.IsPermission(err) {
+			warnUnreadable(p.Warn, err)
+			continue
+		}
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+
+	if !searched {
+		return nil, fmt.Errorf("%w: no service token directory", ErrNotApplicable)
+	}
+	return nil, fmt.Errorf("%w: no readable service token for %s", ErrNotApplicable, uri.Host)
+}
+
+// warnUnreadable passes a warning about a token file which can't be read to
+// warn, if it is set.
+//
+// apt runs methods as the unprivileged _apt user, so files which are only
+// readable by root often can't be read. Ignoring them silently would leave
+// the user wondering why the token isn't used.
+//
+// The home directory of the user running apt often can't be searched by _apt
+// at all, which gives the same error whether or not there is a token file in
+// it. So that users without token files aren't warned on every run, there is
+// only a warning if the directory can be listed and holds the file.
+func warnUnreadable(warn func(string), err error) {
+	var pathErr *os.PathError
+	if warn == nil || !errors.As(err, &pathErr) || !isListed(pathErr.Path) {
+		return
+	}
+	warn(fmt.Sprintf("Ignoring a token file which user %s can't read: %v", currentUser(), err))
+}
+
+// isListed reports whether the directory holding the file can be listed, and
+// lists the file.
+func isListed(filename string) bool {
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if name == filepath.Base(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentUser returns the name of the user the method is running as.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// StoredTokenProvider uses valid user tokens stored by cloudflared or the
+// native login flow. See FindStoredToken.
+type StoredTokenProvider struct {
+	Dir string
+
+	// Audience is the audience tag of the application, which newer versions
+	// of cloudflared name its token after. If it is empty, only the token
+	// stored under the host name alone is used.
+	Audience string
+
+	// Refresh makes the provider inapplicable, as the stored token has been
+	// rejected.
+	Refresh bool
+}
+
+// Name implements the TokenProvider interface.
+func (p *StoredTokenProvider) Name() string {
+	return ProviderTokenDir
+}
+
+// Token implements the TokenProvider interface.
+func (p *StoredTokenProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	if p.Dir == "" || p.Refresh {
+		return nil, fmt.Errorf("%w: stored tokens are not used", ErrNotApplicable)
+	}
+
+	token, err := FindStoredToken(p.Dir, uri.Host, p.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotApplicable, err)
+	}
+	return token, nil
+}
+
+// CloudflaredProvider gets user tokens by running cloudflared, logging the
+// user in if needed.
+type CloudflaredProvider struct {
+	// Path is the cloudflared binary. If it is empty, cloudflared is looked
+	// up in $PATH.
+	Path string
+
+	// Output receives the output of 'cloudflared access login'.
+	Output io.Writer
+
+	// Refresh always logs the user in, rather than using the token
+	// cloudflared already has.
+	Refresh bool
+
+	// NonInteractive never logs the user in. The token cloudflared already
+	// has is still used, but if there isn't one, the provider fails with a
+	// LoginRequiredError.
+	NonInteractive bool
+}
+
+// Name implements the TokenProvider interface.
+func (p *CloudflaredProvider) Name() string {
+	return ProviderCloudflared
+}
+
+// Token implements the TokenProvider interface.
+//
+// The provider isn't applicable if cloudflared isn't installed.
+func (p *CloudflaredProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	prog := p.Path
+	if prog == "" {
+		prog = "cloudflared"
+	}
+
+	w := p.Output
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	token, err := findTokenCloudflared(ctx, uri, prog, w, p.Refresh, !p.NonInteractive)
+	if isNotInstalled(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNotApplicable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// isNotInstalled reports whether err means that a program couldn't be run
+// because it isn't installed.
+func isNotInstalled(err error) bool {
+	return errors.Is(err, osexec.ErrNotFound) || os.IsNotExist(err)
+}
+
+// LoginProvider gets user tokens with the native login flow. See Login.
+type LoginProvider struct {
+	Options LoginOptions
+
+	// NonInteractive makes the provider fail with a LoginRequiredError
+	// rather than logging the user in.
+	NonInteractive bool
+}
+
+// Name implements the TokenProvider interface.
+func (p *LoginProvider) Name() string {
+	return ProviderLogin
+}
+
+// Token implements the TokenProvider interface.
+func (p *LoginProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	if p.NonInteractive {
+		return nil, newLoginRequiredError(uri)
+	}
+
+	opts := p.Options
+	token, err := Login(ctx, uri, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,314 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/exec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is a TokenProvider which returns a fixed result.
+type fakeProvider struct {
+	name  string
+	token Token
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeProvider) Token(ctx context.Context, uri *url.URL) (Token, error) {
+	p.calls++
+	return p.token, p.err
+}
+
+func TestChain(t *testing.T) {
+	uri, err := url.Parse("https://apt.example.com/pkg.deb")
+	require.NoError(t, err)
+
+	token := &ServiceToken{"id", "secret"}
+	notApplicable := fmt.Errorf("%w: not configured", ErrNotApplicable)
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name      string
+		providers []*fakeProvider
+		provider  string
+		calls     []int
+		errors    bool
+	}{
+		{
+			name:      "First",
+			providers: []*fakeProvider{{name: "a", token: token}, {name: "b", token: token}},
+			provider:  "a",
+			calls:     []int{1, 0},
+		},
+		{
+			name:      "Not Applicable",
+			providers: []*fakeProvider{{name: "a", err: notApplicable}, {name: "b", token: token}},
+			provider:  "b",
+			calls:     []int{1, 1},
+		},
+		{
+			name:      "Failed",
+			providers: []*fakeProvider{{name: "a", err: failed}, {name: "b", token: token}},
+			provider:  "a",
+			calls:     []int{1, 0},
+			errors:    true,
+		},
+		{
+			name:      "None Applicable",
+			providers: []*fakeProvider{{name: "a", err: notApplicable}, {name: "b", err: ErrNotApplicable}},
+			calls:     []int{1, 1},
+			errors:    true,
+		},
+		{
+			name:   "Empty",
+			errors: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var chain Chain
+			for _, p := range test.providers {
+				chain = append(chain, p)
+			}
+
+			got, provider, err := chain.Token(context.Background(), uri)
+			assert.Equal(t, test.provider, provider)
+			if test.errors {
+				assert.Error(t, err)
+				assert.Nil(t, got)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, token, got)
+			}
+
+			for i, p := range test.providers {
+				assert.Equal(t, test.calls[i], p.calls, "calls to %s", p.name)
+			}
+		})
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	names := func(chain Chain) []string {
+		var names []string
+		for _, p := range chain {
+			names = append(names, p.Name())
+		}
+		return names
+	}
+
+	chain, err := NewChain(&Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"env", "systemd-credentials", "service-token", "credential-helper", "token-dir", "cloudflared",
+	}, names(chain))
+
+	chain, err = NewChain(&Options{NativeLogin: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"env", "systemd-credentials", "service-token", "credential-helper", "token-dir", "login",
+	}, names(chain))
+
+	chain, err = NewChain(&Options{Providers: []string{"Login", "service-token"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"login", "service-token"}, names(chain))
+
+	_, err = NewChain(&Options{Providers: []string{"service-token", "keyring"}})
+	assert.Error(t, err)
+}
+
+func TestValidatingProvider(t *testing.T) {
+	uri, err := url.Parse("https://apt.example.com/pkg.deb")
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour).Unix()
+	foreign := &UserToken{JWT: makeJWT(fmt.Sprintf(`{"exp":%d,"aud":"other"}`, expires))}
+	valid := &UserToken{JWT: makeJWT(fmt.Sprintf(`{"exp":%d,"aud":"apt"}`, expires))}
+	service := &ServiceToken{"id", "secret"}
+	opts := &ValidationOptions{Audience: "apt"}
+
+	tests := []struct {
+		name     string
+		first    Token
+		expected Token
+		provider string
+	}{
+		{"Valid", valid, valid, "a"},
+		{"Invalid", foreign, service, "b"},
+		{"Service Token", service, service, "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain := Chain{
+				&validatingProvider{&fakeProvider{name: "a", token: test.first}, opts},
+				&validatingProvider{&fakeProvider{name: "b", token: service}, opts},
+			}
+			token, provider, err := chain.Token(context.Background(), uri)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.Equal(t, test.provider, provider)
+		})
+	}
+
+	chain := Chain{&validatingProvider{&fakeProvider{name: "a", token: foreign}, opts}}
+	_, _, err = chain.Token(context.Background(), uri)
+	assert.True(t, errors.Is(err, ErrNotApplicable))
+	assert.Contains(t, err.Error(), "not for audience apt")
+
+	// The wrapper is only added if validation is configured
+	plain, err := NewChain(&Options{Providers: []string{"env"}})
+	require.NoError(t, err)
+	assert.IsType(t, &EnvProvider{}, plain[0])
+
+	validating, err := NewChain(&Options{Providers: []string{"env"}, Validation: *opts})
+	require.NoError(t, err)
+	assert.IsType(t, &validatingProvider{}, validating[0])
+	assert.Equal(t, "env", validating[0].Name())
+}
+
+func TestServiceTokenProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-provider-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+	}
+	write("good.example.com-Service-Token", "id.access\nsecret\n")
+	write("bad.example.com-Service-Token", "id\n")
+
+	provider := &ServiceTokenProvider{Dirs: []string{"", dir}}
+	token, err := provider.Token(context.Background(), &url.URL{Host: "good.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"id.access", "secret"}, token)
+
+	_, err = provider.Token(context.Background(), &url.URL{Host: "bad.example.com"})
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrNotApplicable))
+
+	_, err = provider.Token(context.Background(), &url.URL{Host: "missing.example.com"})
+	assert.True(t, errors.Is(err, ErrNotApplicable))
+
+	provider = &ServiceTokenProvider{}
+	_, err = provider.Token(context.Background(), &url.URL{Host: "good.example.com"})
+	assert.True(t, errors.Is(err, ErrNotApplicable))
+}
+
+func TestServiceTokenProviderDirs(t *testing.T) {
+	system, err := ioutil.TempDir("", "cfd-provider-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(system)
+
+	home, err := ioutil.TempDir("", "cfd-provider-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+
+	write := func(dir, data string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "apt.example.com-Service-Token"), []byte(data), 0600))
+	}
+	write(home, "home.access\nsecret\n")
+
+	var warnings []string
+	provider := &ServiceTokenProvider{
+		Dirs: []string{system, home},
+		Warn: func(msg string) { warnings = append(warnings, msg) },
+	}
+	uri := &url.URL{Host: "apt.example.com"}
+
+	// The home directory is used if there is no system-wide token
+	token, err := provider.Token(context.Background(), uri)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"home.access", "secret"}, token)
+
+	// The system-wide token is preferred
+	write(system, "system.access\nsecret\n")
+	token, err = provider.Token(context.Background(), uri)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"system.access", "secret"}, token)
+	assert.Empty(t, warnings)
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any file")
+	}
+
+	// A token which can't be read is skipped with a warning
+	require.NoError(t, os.Chmod(filepath.Join(system, "apt.example.com-Service-Token"), 0))
+	token, err = provider.Token(context.Background(), uri)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"home.access", "secret"}, token)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "permission denied")
+
+	// A directory which can't be searched may not hold a token at all, so
+	// there is no warning for it
+	require.NoError(t, os.Chmod(system, 0))
+	defer os.Chmod(system, 0700)
+	warnings = nil
+	token, err = provider.Token(context.Background(), uri)
+	require.NoError(t, err)
+	assert.Equal(t, &ServiceToken{"home.access", "secret"}, token)
+	assert.Empty(t, warnings)
+}
+
+func TestCloudflaredProviderNotInstalled(t *testing.T) {
+	exec.Builder = exec.RealBuilder()
+	for _, name := range []string{"SUDO_UID", "SUDO_USER", "PKEXEC_UID", "DOAS_USER"} {
+		t.Setenv(name, "")
+	}
+
+	provider := &CloudflaredProvider{Path: "/nonexistent/cloudflared"}
+	_, err := provider.Token(context.Background(), &url.URL{Scheme: "https", Host: "apt.example.com"})
+	assert.True(t, errors.Is(err, ErrNotApplicable), "unexpected error %v", err)
+}
+
+func TestProvidersNonInteractive(t *testing.T) {
+	for _, name := range []string{"SUDO_UID", "SUDO_USER", "PKEXEC_UID", "DOAS_USER"} {
+		t.Setenv(name, "")
+	}
+	uri := &url.URL{Scheme: "https", Host: "apt.example.com", Path: "/debian/pkg.deb"}
+
+	// cloudflared's existing token is still used
+	jwt := makeUserJWT(time.Hour)
+	fb := exec.NewMockBuilder("TestHelperProcess", exec.MockEntry{Output: jwt})
+	exec.Builder = fb
+	provider := &CloudflaredProvider{Path: "/usr/bin/cloudflared", NonInteractive: true}
+	token, err := provider.Token(context.Background(), uri)
+	require.NoError(t, err)
+	assert.Equal(t, &UserToken{JWT: jwt}, token)
+
+	// but without one, the user isn't logged in
+	fb.Reset(exec.MockEntry{ExitCode: 1})
+	_, err = provider.Token(context.Background(), uri)
+	var loginRequired *LoginRequiredError
+	if assert.True(t, errors.As(err, &loginRequired), "unexpected error %v", err) {
+		assert.Equal(t, "https://apt.example.com/", loginRequired.AppURL)
+	}
+	assert.Len(t, fb.Calls, 1)
+
+	// nor is a rejected token refreshed
+	fb.Reset()
+	provider.Refresh = true
+	_, err = provider.Token(context.Background(), uri)
+	assert.True(t, errors.As(err, &loginRequired), "unexpected error %v", err)
+	assert.Empty(t, fb.Calls)
+
+	login := &LoginProvider{NonInteractive: true}
+	_, err = login.Token(context.Background(), uri)
+	assert.True(t, errors.As(err, &loginRequired), "unexpected error %v", err)
+}
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// loginDomain is the domain Access serves team login pages from.
+	loginDomain = "cloudflareaccess.com"
+
+	// loginPath is the path Access redirects to when a request isn't
+	// authenticated.
+	loginPath = "/cdn-cgi/access/login"
+
+	// sessionCookie is the cookie Access sets when it starts a login.
+	sessionCookie = "CF_AppSession"
+)
+
+// IsRejected reports whether the response shows that Access rejected the
+// credentials sent with the request.
+func IsRejected(resp *http.Response) bool {
+	return Rejection(resp) != ""
+}
+
+// Rejection describes why the response shows that Access rejected the
+// credentials sent with the request, or returns "" if it doesn't.
+//
+// Access rejects a request with a 401 or 403 status, by redirecting it to the
+// login page, or in some configurations by serving the login page with a 200
+// status. Redirects are detected both when the client stops at the redirect
+// and when it follows it to the login page.
+//
+// The origin behind Access may return a 403 of its own, so a 403 is only a
+// rejection if it has one of the CF-Access-* headers Access sets, or is the
+// login page.
+func Rejection(resp *http.Response) string {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden && hasAccessHeader(resp):
+		return fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	if loc, err := resp.Location(); err == nil && IsLoginURL(loc) {
+		return "redirected to the Access login page"
+	}
+
+	if IsLoginPage(resp) {
+		return "served the Access login page"
+	}
+	return ""
+}
+
+// hasAccessHeader reports whether the response has any CF-Access-* header,
+// which only Access sets.
+func hasAccessHeader(resp *http.Response) bool {
+	for name := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(name), "cf-access-") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLoginPage reports whether the response is the Access login page.
+//
+// The login page is recognized either by the final URL of the request, or by
+// an HTML response which starts an Access session.
+func IsLoginPage(resp *http.Response) bool {
+	if resp.Request != nil && IsLoginURL(resp.Request.URL) {
+		return true
+	}
+
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediatype != "text/html" {
+		return false
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookie {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthURL returns the URL a user should visit to log in, given a response
+// which Access rejected.
+//
+// This is the login page if the response points at one, and the root of the
+// application otherwise, which Access will redirect to the login page.
+func AuthURL(resp *http.Response) string {
+	if loc, err := resp.Location(); err == nil && IsLoginURL(loc) {
+		return loc.String()
+	}
+
+	if resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+
+	uri := resp.Request.URL
+	if IsLoginURL(uri) {
+		return uri.String()
+	}
+	return (&url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: "/"}).String()
+}
+
+// IsLoginURL reports whether the URL points at an Access login page.
+func IsLoginURL(uri *url.URL) bool {
+	if uri == nil {
+		return false
+	}
+
+	host := uri.Hostname()
+	if host == loginDomain || strings.HasSuffix(host, "."+loginDomain) {
+		return true
+	}
+	return strings.HasPrefix(uri.Path, loginPath)
+}
+
+// IsAuthURL reports whether the URL is one the user opens to log in to Access,
+// either the command line login endpoint of an application, which cloudflared
+// prints, or a login page.
+func IsAuthURL(uri *url.URL) bool {
+	return uri != nil && (strings.HasPrefix(uri.Path, cliPath) || IsLoginURL(uri))
+}
@@ -0,0 +1,93 @@
+package access
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testResponse(status int, requrl, location string, headers ...string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		resp.Header.Add(headers[i], headers[i+1])
+	}
+	resp.Request = &http.Request{}
+	resp.Request.URL, _ = url.Parse(requrl)
+	if location != "" {
+		resp.Header.Set("Location", location)
+	}
+	return resp
+}
+
+func TestIsRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		resp     *http.Response
+		rejected bool
+	}{
+		{"OK", testResponse(200, "https://repo.example.com/dists/InRelease", ""), false},
+		{"Not Found", testResponse(404, "https://repo.example.com/dists/InRelease", ""), false},
+		{"Unauthorized", testResponse(401, "https://repo.example.com/dists/InRelease", ""), true},
+		{"Forbidden", testResponse(403, "https://repo.example.com/dists/InRelease", "",
+			"CF-Access-Aud", "4714c1358e65fe4b408ad6d432a5f878f08194bdb4752441fd56faefa9b2b6f2"), true},
+		{"Origin Forbidden", testResponse(403, "https://repo.example.com/dists/InRelease", "",
+			"Content-Type", "text/html", "Server", "nginx"), false},
+		{"Forbidden Login Page", testResponse(403, "https://repo.example.com/pool/pkg.deb", "",
+			"Content-Type", "text/html; charset=UTF-8", "Set-Cookie", "CF_AppSession=abc123; Secure"), true},
+		{"Redirect", testResponse(302, "https://repo.example.com/dists/InRelease",
+			"https://team.cloudflareaccess.com/cdn-cgi/access/login/repo.example.com?kid=abc"), true},
+		{"Redirect Elsewhere", testResponse(302, "https://repo.example.com/dists/InRelease",
+			"https://mirror.example.com/dists/InRelease"), false},
+		{"Followed Redirect", testResponse(200,
+			"https://team.cloudflareaccess.com/cdn-cgi/access/login/repo.example.com", ""), true},
+		{"Login Path", testResponse(200, "https://repo.example.com/cdn-cgi/access/login/repo.example.com", ""), true},
+		{"Login Page", testResponse(200, "https://repo.example.com/pool/pkg.deb", "",
+			"Content-Type", "text/html; charset=UTF-8", "Set-Cookie", "CF_AppSession=abc123; Secure"), true},
+		{"Plain HTML", testResponse(200, "https://repo.example.com/index.html", "",
+			"Content-Type", "text/html; charset=UTF-8"), false},
+		{"Package With Cookie", testResponse(200, "https://repo.example.com/pool/pkg.deb", "",
+			"Content-Type", "application/vnd.debian.binary-package", "Set-Cookie", "CF_AppSession=abc123"), false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.rejected, IsRejected(test.resp), test.name)
+	}
+}
+
+func TestIsAuthURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		auth bool
+	}{
+		{"https://repo.example.com/cdn-cgi/access/cli?aud=abc&token=def", true},
+		{"https://team.cloudflareaccess.com/cdn-cgi/access/login/repo.example.com?kid=abc", true},
+		{"https://team.cloudflareaccess.com/", true},
+		{"https://repo.example.com/cdn-cgi/access/login/repo.example.com", true},
+		{"https://repo.example.com/dists/stable/InRelease", false},
+		{"https://developers.cloudflare.com/cloudflare-one/", false},
+		{"https://repo.example.com/cdn-cgi/access/certs", false},
+	}
+
+	for _, test := range tests {
+		uri, err := url.Parse(test.url)
+		assert.NoError(t, err)
+		assert.Equal(t, test.auth, IsAuthURL(uri), test.url)
+	}
+}
+
+func TestAuthURL(t *testing.T) {
+	login := "https://team.cloudflareaccess.com/cdn-cgi/access/login/repo.example.com?kid=abc"
+
+	resp := testResponse(302, "https://repo.example.com/dists/InRelease", login)
+	assert.Equal(t, login, AuthURL(resp))
+
+	resp = testResponse(200, login, "")
+	assert.Equal(t, login, AuthURL(resp))
+
+	resp = testResponse(200, "https://repo.example.com/pool/pkg.deb", "",
+		"Content-Type", "text/html", "Set-Cookie", "CF_AppSession=abc123")
+	assert.Equal(t, "https://repo.example.com/", AuthURL(resp))
+	assert.Equal(t, "served the Access login page", Rejection(resp))
+}
@@ -0,0 +1,99 @@
+package access
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FindStoredToken returns a valid user token for the application at the host
+// from the directory cloudflared stores tokens in, usually ~/.cloudflared.
+//
+// cloudflared stores the token for the application at the root of the host
+// as ${HOST}-token or, in newer versions, with the application's audience tag
+// added, as ${HOST}-${AUD}-token. Tokens for other applications on the same
+// host are stored with their own audience tags, so ${HOST}-${AUD}-token is
+// only used if aud, the audience tag of the application, is known. Tokens
+// which have expired, or are about to, are skipped. If both files hold a
+// valid token, the one which expires last is returned.
+func FindStoredToken(dir, host, aud string) (*UserToken, error) {
+	// cloudflared names tokens after the host name, without the port
+	host = stripPort(host)
+
+	names := []string{host + "-token"}
+	if aud != "" {
+		names = append(names, host+"-"+aud+"-token")
+	}
+
+	var best *UserToken
+	var bestExpiry time.Time
+	now := time.Now()
+
+	for _, name := range names {
+		jwt, expires, err := loadStoredToken(filepath.Join(dir, name), now)
+		if err != nil {
+			continue
+		}
+
+		if best == nil || expires.After(bestExpiry) {
+			best, bestExpiry = &UserToken{JWT: jwt}, expires
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no valid token for %s in %s", host, dir)
+	}
+	return best, nil
+}
+
+// loadStoredToken reads a token file and returns the token and its expiry
+// time, or an error if the token isn't valid at now. See Claims.checkTimes.
+func loadStoredToken(filename string, now time.Time) (string, time.Time, error) {
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	jwt := strings.TrimSpace(string(data))
+	claims, err := ParseClaims(jwt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := claims.checkTimes(now); err != nil {
+		return "", time.Time{}, fmt.Errorf("token in %s: %v", filename, err)
+	}
+	return jwt, claims.ExpiresAt(), nil
+}
+
+// storeUserToken writes the token for the host to ${dir}/${host}-token, where
+// cloudflared keeps its tokens.
+//
+// The token is written to a temporary file which is renamed into place, so a
+// concurrent reader never sees part of a token.
+func storeUserToken(dir, host, jwt string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create token directory: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+host+"-token")
+	if err != nil {
+		return fmt.Errorf("unable to store token: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(jwt); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to store token: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to store token: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, host+"-token")); err != nil {
+		return fmt.Errorf("unable to store token: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package access
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindStoredToken(t *testing.T) {
+	expiring := func(d time.Duration) string {
+		return makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(d).Unix()))
+	}
+	valid, later := expiring(time.Hour), expiring(2*time.Hour)
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		host     string
+		aud      string
+		expected string
+	}{
+		{
+			name:     "Host Token",
+			files:    map[string]string{"apt.example.com-token": valid},
+			host:     "apt.example.com",
+			expected: valid,
+		},
+		{
+			name:     "Port",
+			files:    map[string]string{"apt.example.com-token": valid},
+			host:     "apt.example.com:8443",
+			expected: valid,
+		},
+		{
+			name:     "Audience Token",
+			files:    map[string]string{"apt.example.com-0123abcd-token": valid + "\n"},
+			host:     "apt.example.com",
+			aud:      "0123abcd",
+			expected: valid,
+		},
+		{
+			name:  "Unknown Audience",
+			files: map[string]string{"apt.example.com-0123abcd-token": valid},
+			host:  "apt.example.com",
+		},
+		{
+			name: "Two Applications",
+			files: map[string]string{
+				"apt.example.com-0123abcd-token": valid,
+				"apt.example.com-4567cdef-token": later,
+			},
+			host:     "apt.example.com",
+			aud:      "0123abcd",
+			expected: valid,
+		},
+		{
+			name: "Latest Expiry",
+			files: map[string]string{
+				"apt.example.com-token":          valid,
+				"apt.example.com-0123abcd-token": later,
+			},
+			host:     "apt.example.com",
+			aud:      "0123abcd",
+			expected: later,
+		},
+		{
+			name: "Expired",
+			files: map[string]string{
+				"apt.example.com-token":     expiring(-time.Hour),
+				"apt.example.com-aud-token": expiring(30 * time.Second),
+			},
+			host: "apt.example.com",
+			aud:  "aud",
+		},
+		{
+			name:  "No Expiry",
+			files: map[string]string{"apt.example.com-token": makeJWT(`{}`)},
+			host:  "apt.example.com",
+		},
+		{
+			name:  "Org Token",
+			files: map[string]string{"apt.example.com-org-token": valid},
+			host:  "apt.example.com",
+		},
+		{
+			name: "Other Hosts",
+			files: map[string]string{
+				"apt.example.community-token": valid,
+				"example.com-token":           valid,
+			},
+			host: "apt.example.com",
+		},
+		{
+			name:  "Malformed",
+			files: map[string]string{"apt.example.com-token": "Unable to find token"},
+			host:  "apt.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cfd-stored-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			for name, data := range test.files {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+			}
+
+			token, err := FindStoredToken(dir, test.host, test.aud)
+			if test.expected == "" {
+				assert.Error(t, err)
+				assert.Nil(t, token)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token.JWT)
+		})
+	}
+}
+
+func TestFindStoredTokenMissingDir(t *testing.T) {
+	_, err := FindStoredToken("/nonexistent/.cloudflared", "apt.example.com", "")
+	assert.Error(t, err)
+}
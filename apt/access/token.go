@@ -11,6 +11,8 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/cloudflare/apt-transport-cloudflared/apt/exec"
 )
@@ -46,28 +48,108 @@ type Token interface {
 	ModifyRequest(r *http.Request)
 }
 
+// Options controls where GetToken looks for tokens.
+type Options struct {
+	// SystemTokenDir is the system-wide directory service tokens are loaded
+	// from, e.g. /etc/apt/cfd+https. It is searched before ServiceTokenDir.
+	SystemTokenDir string
+
+	// ServiceTokenDir is the directory service tokens are loaded from. If it
+	// and SystemTokenDir are empty, service token files are not used.
+	ServiceTokenDir string
+
+	// Cloudflared is the cloudflared binary used to get user tokens. If it
+	// is empty, cloudflared is looked up in $PATH.
+	Cloudflared string
+
+	// Output is used to redirect os.Stderr from the subprocess (if one is
+	// spawned), or to show the login URL when NativeLogin is set. If it is
+	// nil, the output is discarded.
+	Output io.Writer
+
+	// NativeLogin logs the user in with Login instead of running
+	// cloudflared.
+	NativeLogin bool
+
+	// TransferURL is the token transfer service used by NativeLogin. If it
+	// is empty, DefaultTransferURL is used.
+	TransferURL string
+
+	// Client is used for the requests NativeLogin makes. If it is nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// TokenDir is the directory user tokens are stored in, usually
+	// ~/.cloudflared. A valid token found there is used without logging in.
+	// If it is empty, stored tokens are not used, and NativeLogin doesn't
+	// store tokens.
+	TokenDir string
+
+	// Refresh ignores any token stored by cloudflared, and always logs the
+	// user in again. This is used once Access has rejected the stored
+	// token.
+	Refresh bool
+
+	// Providers lists the names of the token providers to try, in order.
+	// If it is empty, DefaultProviders is used.
+	Providers []string
+
+	// CredentialHelper is the credential helper run by HelperProvider. If it
+	// is empty, no helper is run.
+	CredentialHelper string
+
+	// CredentialHelperArgs are the arguments the credential helper is run
+	// with.
+	CredentialHelperArgs []string
+
+	// CredentialHelperTimeout is how long the credential helper may run. If
+	// it is 0, the helper may run for 30 seconds.
+	CredentialHelperTimeout time.Duration
+
+	// AllowInsecureTokens uses service token files which other users could
+	// read or replace, rather than refusing them.
+	AllowInsecureTokens bool
+
+	// Warn, if set, is called with a warning for problems which don't stop a
+	// token from being found, e.g. a service token file which can't be read.
+	Warn func(msg string)
+
+	// AuthConf caches the entries of the auth.conf-style files in the
+	// service token directories. If it is nil, the files are loaded for
+	// every token.
+	AuthConf *AuthConfCache
+
+	// NonInteractive never asks the user to log in, e.g. on a machine with
+	// no one to open a browser. Where the user would have to log in, a
+	// LoginRequiredError is returned instead.
+	NonInteractive bool
+
+	// Validation controls how user tokens are checked before they are used.
+	// Tokens which fail the checks are skipped, and the next provider is
+	// tried.
+	Validation ValidationOptions
+}
+
 // GetToken attempts to get a token for the given uri.
 //
-// This function first attempts to load a service token for the requested URI,
-// then attempts to load a user JWT using cloudflared if no service token was
-// found.
-//
-// The writer argument is used to redirect os.Stderr from the subprocess (if
-// one is spawned). If you want to silence the output from os.Stderr, use
-// ioutil.Discard as the writer. If the writer is nil, it is implicitly
-// converted to ioutil.Discard.
-func GetToken(ctx context.Context, uri *url.URL, servicetokendir string,
-	usecloudflared bool, w io.Writer) (Token, error) {
-	// Attempt to load a service token
-	if servicetokendir != "" {
-		token, err := FindServiceToken(servicetokendir, uri.Host)
-		if err == nil && token != nil {
-			return token, nil
-		}
-	}
+// The token providers listed in opts are tried in order. By default, this
+// function first attempts to load a service token for the requested URI. If
+// no service token was found, it looks for a valid user JWT stored by
+// cloudflared, and if there isn't one, attempts to get one using cloudflared,
+// or the native login flow if opts.NativeLogin is set.
+func GetToken(ctx context.Context, uri *url.URL, opts *Options) (Token, error) {
+	token, _, err := GetTokenFrom(ctx, uri, opts)
+	return token, err
+}
 
-	// Attempt to get the user token
-	return FindUserToken(ctx, uri, usecloudflared, w)
+// GetTokenFrom is like GetToken, but also returns the name of the provider
+// which produced the token.
+func GetTokenFrom(ctx context.Context, uri *url.URL, opts *Options) (Token, string, error) {
+	chain, err := NewChain(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return chain.Token(ctx, uri)
 }
 
 // ServiceToken is a Cloudflare Access token used for services which need
@@ -88,9 +170,9 @@ type ServiceToken struct {
 //   ${CLIENT_ID}
 //   ${CLIENT_SECRET}
 // Whitespace in the Client-ID and Client-Secret will be stripped. The
-// Client-ID must be in the form of:
-//   ${ID}.${HOST}
-// where ${HOST} is the hostname being connected to.
+// Client-ID is in the form of:
+//   ${ID}.access
+// as Access generates it, and says nothing about the hosts it is valid for.
 func ParseServiceToken(data string) (*ServiceToken, error) {
 	// Trim off trailing newlines, then split on newline
 	parts := strings.Split(strings.TrimSpace(data), "\n")
@@ -106,14 +188,28 @@ func ParseServiceToken(data string) (*ServiceToken, error) {
 	}, nil
 }
 
+// stripPort removes the port, if any, from a host.
+func stripPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
+
 // LoadServiceToken takes the given file path and parses a ServiceToken from
 // the file contents.
 //
-// If the file does not exist, then this function returns an error. See the
-// ParseServiceToken() function for more details on how service tokens are
-// parsed.
+// If the file does not exist, or other users could read or replace it, then
+// this function returns an error. See the ParseServiceToken() function for
+// more details on how service tokens are parsed.
 func LoadServiceToken(filepath string) (*ServiceToken, error) {
-	fdata, err := ioutil.ReadFile(filepath)
+	return loadServiceToken(filepath, false, nil)
+}
+
+// loadServiceToken is LoadServiceToken, optionally accepting an insecure
+// file. See readTokenFile.
+func loadServiceToken(filepath string, allowInsecure bool, warn func(string)) (*ServiceToken, error) {
+	fdata, err := readTokenFile(filepath, allowInsecure, warn)
 	if err != nil {
 		return nil, err
 	}
@@ -137,31 +233,89 @@ func (st *ServiceToken) ModifyRequest(req *http.Request) {
 type UserToken struct {
 	// JWT is the content of the user token.
 	JWT string
+
+	// Expires is when the token expires, if it is known other than from the
+	// token's 'exp' claim, e.g. because a credential helper said so.
+	Expires time.Time
 }
 
-func findTokenCloudflared(ctx context.Context, uri *url.URL, w io.Writer) (*UserToken, error) {
+// Identity describes who a token authenticates as, for showing to the user:
+// the Client-ID of a service token, or the email address, or failing that the
+// subject, of a user token. Secrets, and the token itself, are never
+// included.
+func Identity(token Token) string {
+	var identity string
+	switch t := token.(type) {
+	case *ServiceToken:
+		identity = "service token " + t.ID
+	case *UserToken:
+		identity = "unknown user"
+		if claims, err := ParseClaims(t.JWT); err == nil && claims.Email != "" {
+			identity = "user " + claims.Email
+		} else if err == nil && claims.Subject != "" {
+			identity = "user " + claims.Subject
+		}
+	default:
+		identity = "unknown credentials"
+	}
+
+	// The claims come from outside, so keep them from breaking up the line
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, identity)
+}
+
+// findTokenCloudflared gets a user token using cloudflared.
+//
+// cloudflared is first asked for the token it already has for the
+// application with 'cloudflared access token', and only if it doesn't print a
+// well-formed JWT which is still valid, or refresh is set, is the user asked
+// to log in with 'cloudflared access login', which may open a browser.
+// If interactive isn't set, the user isn't asked to log in, and a
+// LoginRequiredError is returned instead.
+//
+// If apt was run with sudo, pkexec or doas, cloudflared is run as the user who
+// ran it, so that the user's own tokens and browser are used.
+func findTokenCloudflared(ctx context.Context, uri *url.URL, prog string, w io.Writer,
+	refresh, interactive bool) (*UserToken, error) {
 	baseuri := uri.Scheme + "://" + uri.Host
 
-	var cmdLogin, cmdToken []string
-	prog := "cloudflared"
-	sudoUser := os.Getenv("SUDO_USER")
-	if sudoUser != "" {
-		prog = "su"
-		cmdLogin = []string{sudoUser, "-c", "cloudflared access login " + baseuri}
-		cmdToken = []string{sudoUser, "-c", "cloudflared access token --app " + baseuri}
-	} else {
-		cmdLogin = []string{"access", "login", baseuri}
-		cmdToken = []string{"access", "token", "--app", baseuri}
+	runAs, err := exec.InvokingUser()
+	if err != nil {
+		return nil, err
+	}
+
+	cmdToken := []string{"access", "token", "--app", baseuri}
+	if !refresh {
+		token, err := runAccessToken(ctx, runAs, prog, cmdToken)
+		if err == nil {
+			return token, nil
+		}
+		if ctx.Err() != nil || isNotInstalled(err) {
+			return nil, err
+		}
 	}
 
-	login := exec.CommandContext(ctx, prog, cmdLogin...)
+	if !interactive {
+		return nil, newLoginRequiredError(uri)
+	}
+
+	login := exec.CommandAsContext(ctx, runAs, prog, "access", "login", baseuri)
 	login.Stderr = w
-	err := login.Run()
-	if err != nil {
+	if err := login.Run(); err != nil {
 		return nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, prog, cmdToken...)
+	return runAccessToken(ctx, runAs, prog, cmdToken)
+}
+
+// runAccessToken runs 'cloudflared access token' as the user and returns the
+// token it prints, which must be a well-formed JWT which is still valid.
+func runAccessToken(ctx context.Context, runAs *exec.User, prog string, args []string) (*UserToken, error) {
+	cmd := exec.CommandAsContext(ctx, runAs, prog, args...)
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -176,22 +330,48 @@ func findTokenCloudflared(ctx context.Context, uri *url.URL, w io.Writer) (*User
 		return nil, errors.New("bad output from `cloudflared access token`: unable to get token")
 	}
 
-	return &UserToken{token}, nil
+	if err := checkUserJWT(token, time.Now()); err != nil {
+		return nil, fmt.Errorf("bad output from `cloudflared access token`: %v", err)
+	}
+
+	return &UserToken{JWT: token}, nil
 }
 
 func findToken(ctx context.Context, uri *url.URL, w io.Writer) (*UserToken, error) {
-	// TODO: Use cloudflared library directly
-	return findTokenCloudflared(ctx, uri, w)
+	return Login(ctx, uri, &LoginOptions{
+		TokenDir: UserTokenDir(),
+		Output:   w,
+	})
+}
+
+// UserTokenDir returns the directory cloudflared keeps user tokens in, or ""
+// if the home directory is unknown.
+func UserTokenDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".cloudflared")
 }
 
 // FindUserToken attempts to fetch a user token for the given URI.
+//
+// A valid token stored by cloudflared in ~/.cloudflared is used if there is
+// one. Otherwise, if cloudflared is true, the token is fetched by running
+// cloudflared, or else the native login flow is used.
 func FindUserToken(ctx context.Context, uri *url.URL, cloudflared bool, w io.Writer) (*UserToken, error) {
 	if w == nil {
 		w = ioutil.Discard
 	}
 
+	if dir := UserTokenDir(); dir != "" {
+		if token, err := FindStoredToken(dir, uri.Host, ""); err == nil {
+			return token, nil
+		}
+	}
+
 	if cloudflared {
-		return findTokenCloudflared(ctx, uri, w)
+		return findTokenCloudflared(ctx, uri, "cloudflared", w, false, true)
 	}
 	return findToken(ctx, uri, w)
 }
@@ -2,7 +2,14 @@ package access
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +20,11 @@ func TestHelperProcess(t *testing.T) {
 	exec.MockExecHelper()
 }
 
+// makeUserJWT builds an unsigned JWT which expires after the given duration.
+func makeUserJWT(expiresIn time.Duration) string {
+	return makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(expiresIn).Unix()))
+}
+
 func testParseServiceToken(t *testing.T, val, id, secret string, errors bool) {
 	tok, err := ParseServiceToken(val)
 	if err != nil {
@@ -43,6 +55,36 @@ func TestParseServiceToken(t *testing.T) {
 	testParseServiceToken(t, "Hello\n", "", "", true)
 	testParseServiceToken(t, "\nWorld", "", "", true)
 	testParseServiceToken(t, "", "", "", true)
+
+	// A Client-ID as Access generates it
+	testParseServiceToken(t, "bd2744144725d2651d39363df6807599.access\n3e2c2ad371b00777a443f0c639c1e036\n",
+		"bd2744144725d2651d39363df6807599.access", "3e2c2ad371b00777a443f0c639c1e036", false)
+}
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    Token
+		expected string
+	}{
+		{"Service Token", &ServiceToken{ID: "id.access", Secret: "secret"}, "service token id.access"},
+		{"Email", &UserToken{JWT: makeJWT(`{"email":"user@example.com","sub":"1234"}`)}, "user user@example.com"},
+		{"Subject", &UserToken{JWT: makeJWT(`{"sub":"1234"}`)}, "user 1234"},
+		{"No Identity", &UserToken{JWT: makeJWT(`{}`)}, "unknown user"},
+		{"Opaque Token", &UserToken{JWT: "token-1a24fd"}, "unknown user"},
+		{
+			"Control Characters",
+			&UserToken{JWT: makeJWT(`{"email":"a@b\n\n201 URI Done"}`)},
+			"user a@b??201 URI Done",
+		},
+		{"Other Token", nil, "unknown credentials"},
+	}
+
+	for _, test := range tests {
+		if identity := Identity(test.token); identity != test.expected {
+			t.Errorf("%s: expected identity %q, got %q", test.name, test.expected, identity)
+		}
+	}
 }
 
 func testFindUserTokenError(ctx context.Context, t *testing.T, uri *url.URL, errmsg string) {
@@ -53,6 +95,14 @@ func testFindUserTokenError(ctx context.Context, t *testing.T, uri *url.URL, err
 }
 
 func TestFindUserToken(t *testing.T) {
+	// Make sure no real tokens are found
+	dir, err := ioutil.TempDir("", "cfd-token-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("HOME", dir)
+
 	// Mock out the exec.CommandContext
 	fb := exec.NewMockBuilder("TestHelperProcess", exec.MockEntry{Sleep: time.Second})
 	exec.Builder = fb
@@ -62,35 +112,293 @@ func TestFindUserToken(t *testing.T) {
 
 	uri, _ := url.Parse("https://httpbin.org/get")
 
-	// Error, hang in first command
+	// Error, hang in `cloudflared access token`
 	testFindUserTokenError(ctx, t, uri, "Expected error due to hung process, got %v")
 
-	// Error, hang in second command
-	fb.Reset(exec.MockEntry{}, exec.MockEntry{Sleep: time.Second})
+	// Error, hang in `cloudflared access login`
+	fb.Reset(exec.MockEntry{ExitCode: 1}, exec.MockEntry{Sleep: time.Second})
 	testFindUserTokenError(ctx, t, uri, "Expected error due to hung process, got %v")
 
 	// Not testing hangs, so meh
 	ctx = context.Background()
 
 	// Error - Bad exit from `cloudflared access login`
-	fb.Reset(exec.MockEntry{ExitCode: 1})
+	fb.Reset(exec.MockEntry{ExitCode: 1}, exec.MockEntry{ExitCode: 1})
 	testFindUserTokenError(ctx, t, uri, "Expected error due to bad exit code, got %v")
 
-	// Error - Bad exit from `cloudflared access token`
-	fb.Reset(exec.MockEntry{}, exec.MockEntry{ExitCode: 1})
+	// Error - Bad exit from `cloudflared access token` after logging in
+	fb.Reset(exec.MockEntry{ExitCode: 1}, exec.MockEntry{}, exec.MockEntry{ExitCode: 1})
 	testFindUserTokenError(ctx, t, uri, "Expected error due to bad exit code, got %v")
 
-	// Error - Bad output from `cloudflared access token`
-	fb.Reset(exec.MockEntry{}, exec.MockEntry{Output: "Unable to fetch token"})
+	// Error - Bad output from `cloudflared access token` after logging in
+	fb.Reset(exec.MockEntry{Output: "Unable to find token"}, exec.MockEntry{},
+		exec.MockEntry{Output: "Unable to fetch token"})
 	testFindUserTokenError(ctx, t, uri, "Expected error due to bad output, got %v")
 
-	// Valid, return "token-1a24fd"
-	output := "token-1a24fd"
-	fb.Reset(exec.MockEntry{}, exec.MockEntry{Output: output})
+	// Valid after logging in
+	output := makeUserJWT(time.Hour)
+	fb.Reset(exec.MockEntry{ExitCode: 1}, exec.MockEntry{}, exec.MockEntry{Output: output})
 	out, err := FindUserToken(ctx, uri, true, nil)
 	if err != nil {
 		t.Errorf("Unexpected error getting user token: %v", err)
 	} else if out.JWT != output {
 		t.Errorf("Bad parsed JWT; expected \"%s\", got \"%s\"", output, out.JWT)
 	}
+	if fb.Index != 3 {
+		t.Errorf("Expected 3 commands to be run, got %d", fb.Index)
+	}
+
+	// Valid without logging in, as cloudflared already has a token
+	fb.Reset(exec.MockEntry{Output: output})
+	out, err = FindUserToken(ctx, uri, true, nil)
+	if err != nil {
+		t.Errorf("Unexpected error getting user token: %v", err)
+	} else if out.JWT != output {
+		t.Errorf("Bad parsed JWT; expected \"%s\", got \"%s\"", output, out.JWT)
+	}
+	if fb.Index != 1 {
+		t.Errorf("Expected 1 command to be run, got %d", fb.Index)
+	}
+
+	// Valid without running cloudflared, as there is a stored token
+	stored := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	err = os.MkdirAll(filepath.Join(dir, ".cloudflared"), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, ".cloudflared", "httpbin.org-token"), []byte(stored), 0600)
+	}
+	if err == nil {
+		fb.Reset()
+		out, err = FindUserToken(ctx, uri, true, nil)
+	}
+	if err != nil {
+		t.Errorf("Unexpected error getting user token: %v", err)
+	} else if out.JWT != stored {
+		t.Errorf("Bad stored JWT; expected \"%s\", got \"%s\"", stored, out.JWT)
+	}
+	if fb.Index != 0 {
+		t.Errorf("Expected no commands to be run, got %d", fb.Index)
+	}
+}
+
+func TestGetTokenRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfd-token-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stored := makeJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(3*time.Hour).Unix()))
+	if err := ioutil.WriteFile(filepath.Join(dir, "httpbin.org-token"), []byte(stored), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := makeUserJWT(time.Hour)
+	fb := exec.NewMockBuilder("TestHelperProcess", exec.MockEntry{}, exec.MockEntry{Output: fresh})
+	exec.Builder = fb
+
+	uri, _ := url.Parse("https://httpbin.org/get")
+	cache := NewTokenCache()
+	opts := &Options{TokenDir: dir}
+
+	token, err := cache.GetToken(context.Background(), uri, opts)
+	if err != nil || token.(*UserToken).JWT != stored {
+		t.Fatalf("Expected the stored token, got %v, %v", token, err)
+	}
+
+	// Once the stored token is rejected, the user is logged in again
+	cache.Invalidate(CacheKey(uri), token)
+	token, err = cache.GetToken(context.Background(), uri, opts)
+	if err != nil || token.(*UserToken).JWT != fresh {
+		t.Fatalf("Expected a new token, got %v, %v", token, err)
+	}
+	if fb.Index != 2 {
+		t.Errorf("Expected `cloudflared access login` and `access token` to be run, got %d commands", fb.Index)
+	}
+
+	// Once the new token expires, stored tokens are used again
+	cache.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	token, err = cache.GetToken(context.Background(), uri, opts)
+	if err != nil || token.(*UserToken).JWT != stored {
+		t.Fatalf("Expected the stored token again, got %v, %v", token, err)
+	}
+	if fb.Index != 2 {
+		t.Errorf("Expected cloudflared not to be run again, got %d commands", fb.Index)
+	}
+}
+
+func TestFindTokenCloudflared(t *testing.T) {
+	for _, name := range []string{"SUDO_UID", "SUDO_USER", "PKEXEC_UID", "DOAS_USER"} {
+		t.Setenv(name, "")
+	}
+
+	valid := makeUserJWT(time.Hour)
+	unable := "Unable to find token for provided application."
+	tests := []struct {
+		name        string
+		entries     []exec.MockEntry
+		refresh     bool
+		interactive bool
+		expected    []string
+		errors      bool
+	}{
+		{
+			name:        "Existing Token",
+			entries:     []exec.MockEntry{{Output: valid + "\n"}},
+			interactive: true,
+			expected:    []string{"token"},
+		},
+		{
+			name:        "No Token",
+			entries:     []exec.MockEntry{{ExitCode: 1}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Unable To Find Token",
+			entries:     []exec.MockEntry{{Output: unable}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Empty Output",
+			entries:     []exec.MockEntry{{}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Malformed Token",
+			entries:     []exec.MockEntry{{Output: "token-1a24fd"}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Expired Token",
+			entries:     []exec.MockEntry{{Output: makeUserJWT(-time.Hour)}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Token About To Expire",
+			entries:     []exec.MockEntry{{Output: makeUserJWT(time.Second)}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Token Without Expiry",
+			entries:     []exec.MockEntry{{Output: makeJWT(`{"sub":"user"}`)}, {}, {Output: valid}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+		},
+		{
+			name:        "Login Fails",
+			entries:     []exec.MockEntry{{ExitCode: 1}, {ExitCode: 1}},
+			interactive: true,
+			expected:    []string{"token", "login"},
+			errors:      true,
+		},
+		{
+			name:        "Bad Token After Login",
+			entries:     []exec.MockEntry{{ExitCode: 1}, {}, {Output: makeUserJWT(-time.Hour)}},
+			interactive: true,
+			expected:    []string{"token", "login", "token"},
+			errors:      true,
+		},
+		{
+			name:        "Refresh",
+			entries:     []exec.MockEntry{{}, {Output: valid}},
+			refresh:     true,
+			interactive: true,
+			expected:    []string{"login", "token"},
+		},
+		{
+			name:     "Non-Interactive",
+			entries:  []exec.MockEntry{{Output: valid}},
+			expected: []string{"token"},
+		},
+		{
+			name:     "Non-Interactive Without Token",
+			entries:  []exec.MockEntry{{Output: makeUserJWT(-time.Hour)}},
+			expected: []string{"token"},
+			errors:   true,
+		},
+	}
+
+	uri, _ := url.Parse("https://apt.example.com/debian/pkg.deb")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fb := exec.NewMockBuilder("TestHelperProcess", test.entries...)
+			exec.Builder = fb
+
+			token, err := findTokenCloudflared(context.Background(), uri, "cloudflared", nil,
+				test.refresh, test.interactive)
+			if test.errors {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", token)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error getting user token: %v", err)
+			} else if token.JWT != valid {
+				t.Errorf("Bad parsed JWT; expected \"%s\", got \"%s\"", valid, token.JWT)
+			}
+			var required *LoginRequiredError
+			if errors.As(err, &required) != (test.errors && !test.interactive) {
+				t.Errorf("Only a failed non-interactive run should require logging in, got %v", err)
+			}
+
+			var commands []string
+			for _, call := range fb.Calls {
+				commands = append(commands, call.Args[1])
+				expected := []string{"access", call.Args[1], "https://apt.example.com"}
+				if call.Args[1] == "token" {
+					expected = []string{"access", "token", "--app", "https://apt.example.com"}
+				}
+				if strings.Join(call.Args, " ") != strings.Join(expected, " ") {
+					t.Errorf("Unexpected arguments %v", call.Args)
+				}
+			}
+			if strings.Join(commands, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("Expected `cloudflared access` %v to be run, got %v", test.expected, commands)
+			}
+		})
+	}
+}
+
+func TestFindTokenCloudflaredRunAs(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("there is no nobody user")
+	}
+	t.Setenv("SUDO_UID", nobody.Uid)
+
+	jwt := makeUserJWT(time.Hour)
+	fb := exec.NewMockBuilder("TestHelperProcess", exec.MockEntry{ExitCode: 1}, exec.MockEntry{},
+		exec.MockEntry{Output: jwt})
+	exec.Builder = fb
+
+	uri, _ := url.Parse("https://apt.example.com/debian/pkg.deb")
+	token, err := findTokenCloudflared(context.Background(), uri, "/usr/bin/cloudflared", nil, false, true)
+	if err != nil {
+		t.Fatalf("Unexpected error getting user token: %v", err)
+	}
+	if token.JWT != jwt {
+		t.Errorf("Bad parsed JWT; expected \"%s\", got \"%s\"", jwt, token.JWT)
+	}
+
+	// cloudflared is run directly as the user who ran sudo, without a shell
+	expected := [][]string{
+		{"access", "token", "--app", "https://apt.example.com"},
+		{"access", "login", "https://apt.example.com"},
+		{"access", "token", "--app", "https://apt.example.com"},
+	}
+	if len(fb.Calls) != len(expected) {
+		t.Fatalf("Expected %d commands to be run, got %d", len(expected), len(fb.Calls))
+	}
+	for i, call := range fb.Calls {
+		if call.Cmd != "/usr/bin/cloudflared" || strings.Join(call.Args, " ") != strings.Join(expected[i], " ") {
+			t.Errorf("Unexpected command %s %v", call.Cmd, call.Args)
+		}
+		if call.User == nil || call.User.Username != "nobody" {
+			t.Errorf("Expected %s %v to run as nobody, got %v", call.Cmd, call.Args, call.User)
+		}
+	}
 }
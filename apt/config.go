@@ -0,0 +1,509 @@
+package apt
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/access"
+)
+
+const (
+	// configPrefix is the prefix of every configuration item used by the
+	// method.
+	configPrefix = "Acquire::cfd+https::"
+
+	// defaultTimeout is how long to wait for a token if apt does not
+	// configure Acquire::cfd+https::Timeout.
+	defaultTimeout = 45 * time.Second
+
+	// defaultRetryDelay is the delay before the first retry of a failed
+	// request if apt does not configure Acquire::cfd+https::Retry-Delay.
+	defaultRetryDelay = time.Second
+
+	// defaultCloudflared is the cloudflared binary used if apt does not
+	// configure Acquire::cfd+https::Cloudflared.
+	defaultCloudflared = "cloudflared"
+
+	// defaultSystemTokenDir is the system-wide directory service tokens are
+	// loaded from if apt does not configure Acquire::cfd+https::System-Token-Dir.
+	defaultSystemTokenDir = "/etc/apt/cfd+https/"
+
+	// The values of Auth-URL-Output, which say how the URL a user logs in
+	// at is shown.
+	authURLStatus  = "status"
+	authURLWarning = "warning"
+	authURLStderr  = "stderr"
+
+	// The values of Auth-URL-QR, which say where the URL a user logs in at
+	// is drawn as a QR code.
+	authURLQRNone = "none"
+	authURLQRTTY  = "tty"
+
+	// proxyDirect is the Proxy value which disables any proxy, matching the
+	// value apt uses for its own methods.
+	proxyDirect = "DIRECT"
+)
+
+// Config holds the settings for the method.
+//
+// Settings are read from the 'Config-Item' fields of apt's '601 Configuration'
+// message. Global settings are named Acquire::cfd+https::<Setting>, and can
+// be overridden for a single host with Acquire::cfd+https::<host>::<Setting>.
+type Config struct {
+	// Timeout is how long to wait for a token, including the time it takes
+	// the user to log in (Timeout, in seconds).
+	Timeout time.Duration
+
+	// Retries is the number of times a request which fails with a transient
+	// error, or a download which is cut short, is retried (Retries).
+	Retries int
+
+	// RetryDelay is the delay before the first retry of a failed request,
+	// which doubles with each retry (Retry-Delay, in seconds).
+	RetryDelay time.Duration
+
+	// Proxy is the URL of the proxy to send requests through, or "DIRECT" to
+	// not use a proxy (Proxy). If empty, the proxy is taken from the
+	// environment.
+	Proxy string
+
+	// SystemTokenDir is the system-wide directory service tokens are loaded
+	// from, before ServiceTokenDir (System-Token-Dir). Unlike the home
+	// directory, it doesn't depend on which user apt runs the method as.
+	SystemTokenDir string
+
+	// ServiceTokenDir is the directory service tokens are loaded from
+	// (Service-Token-Dir).
+	ServiceTokenDir string
+
+	// AllowInsecureTokens uses service token files which other users could
+	// read or replace, with a warning, rather than refusing them
+	// (Allow-Insecure-Tokens).
+	AllowInsecureTokens bool
+
+	// UserAgent is sent as the User-Agent of every request if set
+	// (User-Agent).
+	UserAgent string
+
+	// Cloudflared is the cloudflared binary used to get user tokens
+	// (Cloudflared).
+	Cloudflared string
+
+	// NativeLogin logs users in to Access without running cloudflared
+	// (Native-Login).
+	NativeLogin bool
+
+	// TransferURL is the token transfer service used by the native login
+	// (Transfer-URL). If empty, the service cloudflared uses is used.
+	TransferURL string
+
+	// TokenDir is the directory user tokens are stored in by cloudflared and
+	// the native login (Token-Dir). A valid token found there is used
+	// without logging in.
+	TokenDir string
+
+	// Providers lists the sources tokens are taken from, in the order they
+	// are tried (Providers, separated by commas). If empty, the default
+	// order is used.
+	Providers []string
+
+	// Interactive says whether the user may be asked to log in
+	// (Interactive, "auto" or a boolean). When they may not, a URI for which
+	// no token can be found without them fails at once.
+	Interactive InteractiveMode
+
+	// ShowIdentity shows who the method authenticates to each host as, and
+	// where the token came from, in a status message (Show-Identity).
+	ShowIdentity bool
+
+	// CredentialHelper is the program which is run to get tokens
+	// (Credential-Helper). The value is the path or name of the program
+	// alone, which may contain spaces. If empty, no helper is run.
+	CredentialHelper string
+
+	// CredentialHelperArgs are the arguments the credential helper is run
+	// with (Credential-Helper-Args, separated by spaces). There is no
+	// quoting, so an argument can't contain a space.
+	CredentialHelperArgs []string
+
+	// CredentialHelperTimeout is how long the credential helper may run
+	// (Credential-Helper-Timeout, in seconds).
+	CredentialHelperTimeout time.Duration
+
+	// TeamDomain is the Access team domain which must have issued user
+	// tokens, e.g. example.cloudflareaccess.com (Team-Domain). If empty, the
+	// issuer of tokens isn't checked.
+	TeamDomain string
+
+	// Audience is the audience tag of the Access application user tokens
+	// must be for (Audience). If empty, the audience isn't checked.
+	Audience string
+
+	// VerifySignature checks the signature of user tokens against the
+	// signing keys of TeamDomain (Verify-Signature).
+	VerifySignature bool
+
+	// CertsCacheDir is the directory the signing keys of Access teams are
+	// kept in between runs (Certs-Cache-Dir). If empty, they are fetched
+	// again for each run. This can only be set globally.
+	CertsCacheDir string
+
+	// Workers is the number of acquires handled at once (Workers). This can
+	// only be set globally.
+	Workers int
+
+	// AuthURLOutput is how the URL a user must open to log in is shown
+	// (Auth-URL-Output): as a "warning" or "status" message to apt, or
+	// written to "stderr". Apt cuts status messages down to the width of
+	// its progress line, so long URLs are only shown in full as warnings.
+	// This can only be set globally.
+	AuthURLOutput string
+
+	// AuthURLQR is where the URL a user must open to log in is also drawn as
+	// a QR code, so that they can open it on a phone (Auth-URL-QR): on the
+	// controlling "tty", or "none". This can only be set globally.
+	AuthURLQR string
+
+	// ETagCache is the file the ETags of downloaded files are kept in
+	// between runs (ETag-Cache). If empty, ETags are only remembered for the
+	// current run. This can only be set globally.
+	ETagCache string
+
+	// hosts holds the settings overridden for each host, in the order they
+	// were set.
+	hosts map[string][]configItem
+}
+
+// configItem is a single setting from apt.
+type configItem struct {
+	key   string
+	value string
+}
+
+// NewConfig creates a Config holding the default settings.
+func NewConfig() *Config {
+	return &Config{
+		Timeout:        defaultTimeout,
+		RetryDelay:     defaultRetryDelay,
+		SystemTokenDir: defaultSystemTokenDir,
+		Cloudflared:    defaultCloudflared,
+		Workers:        defaultWorkers,
+		AuthURLOutput:  authURLWarning,
+		AuthURLQR:      authURLQRNone,
+		ShowIdentity:   true,
+		hosts:          make(map[string][]configItem),
+	}
+}
+
+// Set applies a 'Config-Item' value of the form Key=Value.
+//
+// Items which aren't for the method are ignored. Apt quotes special
+// characters in both the key and the value as %xx, which are unquoted here.
+func (c *Config) Set(item string) error {
+	parts := strings.SplitN(item, "=", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	key, value := unquoteConfig(parts[0]), unquoteConfig(parts[1])
+	if len(key) < len(configPrefix) || !strings.EqualFold(key[:len(configPrefix)], configPrefix) {
+		return nil
+	}
+
+	names := strings.Split(key[len(configPrefix):], "::")
+	switch len(names) {
+	case 1:
+		return c.set(names[0], value)
+	case 2:
+		if isGlobalSetting(names[1]) {
+			return fmt.Errorf("%s can not be set for a single host", key)
+		}
+
+		// Check the value now, so that bad settings are reported even if
+		// the host is never used.
+		if err := NewConfig().set(names[1], value); err != nil {
+			return err
+		}
+
+		host := strings.ToLower(names[0])
+		c.hosts[host] = append(c.hosts[host], configItem{names[1], value})
+	}
+	return nil
+}
+
+// ForHost returns the settings for the given host, with any overrides for the
+// host applied.
+//
+// Overrides may be given for the host name alone, or for the host name and
+// port, in which case the latter take precedence.
+func (c *Config) ForHost(host string) *Config {
+	cfg := *c
+	host = strings.ToLower(host)
+
+	hostname := host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:i]
+	}
+
+	keys := []string{hostname}
+	if hostname != host {
+		keys = append(keys, host)
+	}
+
+	for _, key := range keys {
+		for _, item := range c.hosts[key] {
+			// The values were checked when they were set
+			_ = cfg.set(item.key, item.value)
+		}
+	}
+	return &cfg
+}
+
+// Validate checks that the settings make sense together, both globally and
+// with the overrides for each host applied. It is called once every item has
+// been set, as apt sends them in no particular order.
+func (c *Config) Validate() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	hosts := make([]string, 0, len(c.hosts))
+	for host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		if err := c.ForHost(host).validate(); err != nil {
+			return fmt.Errorf("%v for %s", err, host)
+		}
+	}
+	return nil
+}
+
+// validate checks the settings for a single host.
+func (c *Config) validate() error {
+	// The signing keys are fetched from the team domain
+	if c.VerifySignature && c.TeamDomain == "" {
+		return fmt.Errorf("%sVerify-Signature requires %sTeam-Domain to be set", configPrefix, configPrefix)
+	}
+	return nil
+}
+
+// set applies a single setting by name.
+func (c *Config) set(name, value string) error {
+	var err error
+	switch strings.ToLower(name) {
+	case "timeout":
+		c.Timeout, err = parseSeconds(value)
+	case "retries":
+		c.Retries, err = parseCount(value, 0)
+	case "retry-delay":
+		var secs int
+		secs, err = parseCount(value, 0)
+		c.RetryDelay = time.Duration(secs) * time.Second
+	case "proxy":
+		c.Proxy, err = parseProxy(value)
+	case "service-token-dir":
+		c.ServiceTokenDir = value
+	case "system-token-dir":
+		c.SystemTokenDir = value
+	case "allow-insecure-tokens":
+		c.AllowInsecureTokens, err = parseBool(value)
+	case "user-agent":
+		c.UserAgent = value
+	case "cloudflared":
+		if value == "" {
+			value = defaultCloudflared
+		}
+		c.Cloudflared = value
+	case "native-login":
+		c.NativeLogin, err = parseBool(value)
+	case "transfer-url":
+		c.TransferURL, err = parseURL(value)
+	case "token-dir":
+		c.TokenDir = value
+	case "providers":
+		c.Providers, err = parseProviders(value)
+	case "interactive":
+		c.Interactive, err = parseInteractive(value)
+	case "show-identity":
+		c.ShowIdentity, err = parseBool(value)
+	case "credential-helper":
+		c.CredentialHelper = value
+	case "credential-helper-args":
+		c.CredentialHelperArgs = strings.Fields(value)
+	case "credential-helper-timeout":
+		c.CredentialHelperTimeout, err = parseSeconds(value)
+	case "team-domain":
+		c.TeamDomain, err = parseTeamDomain(value)
+	case "audience":
+		c.Audience = value
+	case "verify-signature":
+		c.VerifySignature, err = parseBool(value)
+	case "certs-cache-dir":
+		c.CertsCacheDir = value
+	case "workers":
+		c.Workers, err = parseCount(value, 1)
+	case "auth-url-output":
+		c.AuthURLOutput, err = parseAuthURLOutput(value)
+	case "auth-url-qr":
+		c.AuthURLQR, err = parseAuthURLQR(value)
+	case "etag-cache":
+		c.ETagCache = value
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value for %s%s: %v", configPrefix, name, err)
+	}
+	return nil
+}
+
+// isGlobalSetting reports whether the setting applies to the whole method,
+// and so can't be overridden for a single host.
+func isGlobalSetting(name string) bool {
+	return strings.EqualFold(name, "Workers") || strings.EqualFold(name, "ETag-Cache") ||
+		strings.EqualFold(name, "Auth-URL-Output") || strings.EqualFold(name, "Auth-URL-QR") ||
+		strings.EqualFold(name, "Certs-Cache-Dir")
+}
+
+// unquoteConfig reverses the %xx quoting apt applies to configuration items.
+func unquoteConfig(s string) string {
+	unquoted, err := url.PathUnescape(s)
+	if err != nil {
+		return strings.TrimSpace(s)
+	}
+	return strings.TrimSpace(unquoted)
+}
+
+// parseSeconds parses a positive number of seconds.
+func parseSeconds(value string) (time.Duration, error) {
+	secs, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if secs <= 0 {
+		return 0, fmt.Errorf("%d is not a positive number of seconds", secs)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// parseCount parses a number which must be at least min.
+func parseCount(value string, min int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < min {
+		return 0, fmt.Errorf("%d is less than %d", n, min)
+	}
+	return n, nil
+}
+
+// parseBool parses a boolean the way apt does.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "yes", "true", "with", "on", "enable":
+		return true, nil
+	case "0", "no", "false", "without", "off", "disable":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", value)
+}
+
+// parseURL checks that a value is an absolute URL, or empty.
+func parseURL(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	uri, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if uri.Scheme == "" || uri.Host == "" {
+		return "", fmt.Errorf("%q is not a URL", value)
+	}
+	return value, nil
+}
+
+// parseTeamDomain parses an Access team domain, which may be given as a host
+// name or as an https URL, and returns the host name.
+func parseTeamDomain(value string) (string, error) {
+	if value == "" || !strings.Contains(value, "://") {
+		value = strings.TrimSuffix(value, "/")
+		if strings.ContainsAny(value, "/?#@ ") {
+			return "", fmt.Errorf("%q is not a host name", value)
+		}
+		return strings.ToLower(value), nil
+	}
+
+	uri, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if uri.Scheme != "https" || uri.Host == "" || strings.Trim(uri.Path, "/") != "" {
+		return "", fmt.Errorf("%q is not a team domain", value)
+	}
+	return strings.ToLower(uri.Host), nil
+}
+
+// parseProviders parses a list of token provider names, separated by commas
+// or spaces.
+func parseProviders(value string) ([]string, error) {
+	names := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+
+	for _, name := range names {
+		if !access.IsProvider(name) {
+			return nil, fmt.Errorf("unknown token provider %q", name)
+		}
+	}
+	return names, nil
+}
+
+// parseAuthURLOutput checks that an Auth-URL-Output value is one of the ways
+// the URL can be shown.
+func parseAuthURLOutput(value string) (string, error) {
+	switch value = strings.ToLower(value); value {
+	case authURLStatus, authURLWarning, authURLStderr:
+		return value, nil
+	}
+	return "", fmt.Errorf("%q is not one of %s, %s or %s", value, authURLStatus, authURLWarning, authURLStderr)
+}
+
+// parseAuthURLQR checks that an Auth-URL-QR value is one of the places the
+// QR code can be drawn. A false boolean is the same as "none".
+func parseAuthURLQR(value string) (string, error) {
+	switch value = strings.ToLower(value); value {
+	case authURLQRNone, authURLQRTTY:
+		return value, nil
+	}
+	if on, err := parseBool(value); err == nil && !on {
+		return authURLQRNone, nil
+	}
+	return "", fmt.Errorf("%q is not one of %s or %s", value, authURLQRNone, authURLQRTTY)
+}
+
+// parseProxy checks that a proxy value is either "DIRECT" or a URL.
+func parseProxy(value string) (string, error) {
+	if value == "" || strings.EqualFold(value, proxyDirect) {
+		return strings.ToUpper(value), nil
+	}
+
+	uri, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if uri.Scheme == "" || uri.Host == "" {
+		return "", fmt.Errorf("%q is not a proxy URL", value)
+	}
+	return value, nil
+}
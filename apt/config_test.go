@@ -0,0 +1,410 @@
+package apt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    []string
+		expected func(*Config)
+		errors   bool
+	}{
+		{
+			name:     "Defaults",
+			expected: func(c *Config) {},
+		},
+		{
+			name:     "Other Method",
+			items:    []string{"Acquire::http::Timeout=10", "Acquire::cfd+https=Timeout"},
+			expected: func(c *Config) {},
+		},
+		{
+			name:     "Not An Item",
+			items:    []string{"Acquire::cfd+https::Timeout"},
+			expected: func(c *Config) {},
+		},
+		{
+			name:     "Timeout",
+			items:    []string{"Acquire::cfd+https::Timeout=120"},
+			expected: func(c *Config) { c.Timeout = 120 * time.Second },
+		},
+		{
+			name:     "Case Insensitive",
+			items:    []string{"acquire::CFD+HTTPS::timeout=120"},
+			expected: func(c *Config) { c.Timeout = 120 * time.Second },
+		},
+		{
+			name:   "Bad Timeout",
+			items:  []string{"Acquire::cfd+https::Timeout=soon"},
+			errors: true,
+		},
+		{
+			name:   "Zero Timeout",
+			items:  []string{"Acquire::cfd+https::Timeout=0"},
+			errors: true,
+		},
+		{
+			name:     "Retries",
+			items:    []string{"Acquire::cfd+https::Retries=3"},
+			expected: func(c *Config) { c.Retries = 3 },
+		},
+		{
+			name:   "Negative Retries",
+			items:  []string{"Acquire::cfd+https::Retries=-1"},
+			errors: true,
+		},
+		{
+			name:     "Retry Delay",
+			items:    []string{"Acquire::cfd+https::Retry-Delay=5"},
+			expected: func(c *Config) { c.RetryDelay = 5 * time.Second },
+		},
+		{
+			name:     "No Retry Delay",
+			items:    []string{"Acquire::cfd+https::Retry-Delay=0"},
+			expected: func(c *Config) { c.RetryDelay = 0 },
+		},
+		{
+			name:   "Bad Retry Delay",
+			items:  []string{"Acquire::cfd+https::Retry-Delay=later"},
+			errors: true,
+		},
+		{
+			name:     "Native Login",
+			items:    []string{"Acquire::cfd+https::Native-Login=yes"},
+			expected: func(c *Config) { c.NativeLogin = true },
+		},
+		{
+			name:   "Bad Native Login",
+			items:  []string{"Acquire::cfd+https::Native-Login=maybe"},
+			errors: true,
+		},
+		{
+			name:     "Transfer URL",
+			items:    []string{"Acquire::cfd+https::Transfer-URL=https://transfer.example.com/"},
+			expected: func(c *Config) { c.TransferURL = "https://transfer.example.com/" },
+		},
+		{
+			name:   "Bad Transfer URL",
+			items:  []string{"Acquire::cfd+https::Transfer-URL=transfer"},
+			errors: true,
+		},
+		{
+			name:     "Providers",
+			items:    []string{"Acquire::cfd+https::Providers=service-token, Login"},
+			expected: func(c *Config) { c.Providers = []string{"service-token", "login"} },
+		},
+		{
+			name:   "Unknown Provider",
+			items:  []string{"Acquire::cfd+https::Providers=service-token,keyring"},
+			errors: true,
+		},
+		{
+			name:     "Interactive",
+			items:    []string{"Acquire::cfd+https::Interactive=false"},
+			expected: func(c *Config) { c.Interactive = InteractiveOff },
+		},
+		{
+			name:     "Interactive Auto",
+			items:    []string{"Acquire::cfd+https::Interactive=yes", "Acquire::cfd+https::Interactive=Auto"},
+			expected: func(c *Config) { c.Interactive = InteractiveAuto },
+		},
+		{
+			name:   "Bad Interactive",
+			items:  []string{"Acquire::cfd+https::Interactive=sometimes"},
+			errors: true,
+		},
+		{
+			name:     "Credential Helper",
+			items:    []string{"Acquire::cfd+https::Credential-Helper=/opt/Vault%20Tools/vault-helper"},
+			expected: func(c *Config) { c.CredentialHelper = "/opt/Vault Tools/vault-helper" },
+		},
+		{
+			name:     "Credential Helper Args",
+			items:    []string{"Acquire::cfd+https::Credential-Helper-Args=--role%20%20apt"},
+			expected: func(c *Config) { c.CredentialHelperArgs = []string{"--role", "apt"} },
+		},
+		{
+			name:     "Credential Helper Timeout",
+			items:    []string{"Acquire::cfd+https::Credential-Helper-Timeout=5"},
+			expected: func(c *Config) { c.CredentialHelperTimeout = 5 * time.Second },
+		},
+		{
+			name:   "Bad Credential Helper Timeout",
+			items:  []string{"Acquire::cfd+https::Credential-Helper-Timeout=-1"},
+			errors: true,
+		},
+		{
+			name:     "Proxy",
+			items:    []string{"Acquire::cfd+https::Proxy=http://proxy.example.com:3128"},
+			expected: func(c *Config) { c.Proxy = "http://proxy.example.com:3128" },
+		},
+		{
+			name:     "Direct Proxy",
+			items:    []string{"Acquire::cfd+https::Proxy=direct"},
+			expected: func(c *Config) { c.Proxy = "DIRECT" },
+		},
+		{
+			name:   "Bad Proxy",
+			items:  []string{"Acquire::cfd+https::Proxy=proxy.example.com"},
+			errors: true,
+		},
+		{
+			name:     "Service Token Dir",
+			items:    []string{"Acquire::cfd+https::Service-Token-Dir=/etc/tokens"},
+			expected: func(c *Config) { c.ServiceTokenDir = "/etc/tokens" },
+		},
+		{
+			name:     "Allow Insecure Tokens",
+			items:    []string{"Acquire::cfd+https::Allow-Insecure-Tokens=true"},
+			expected: func(c *Config) { c.AllowInsecureTokens = true },
+		},
+		{
+			name:     "System Token Dir",
+			items:    []string{"Acquire::cfd+https::System-Token-Dir=/etc/cfd"},
+			expected: func(c *Config) { c.SystemTokenDir = "/etc/cfd" },
+		},
+		{
+			name:     "Quoted User Agent",
+			items:    []string{"Acquire::cfd+https::User-Agent=Debian%20APT%2fcfd"},
+			expected: func(c *Config) { c.UserAgent = "Debian APT/cfd" },
+		},
+		{
+			name:     "Cloudflared",
+			items:    []string{"Acquire::cfd+https::Cloudflared=/usr/local/bin/cloudflared"},
+			expected: func(c *Config) { c.Cloudflared = "/usr/local/bin/cloudflared" },
+		},
+		{
+			name:     "Workers",
+			items:    []string{"Acquire::cfd+https::Workers=8"},
+			expected: func(c *Config) { c.Workers = 8 },
+		},
+		{
+			name:   "Zero Workers",
+			items:  []string{"Acquire::cfd+https::Workers=0"},
+			errors: true,
+		},
+		{
+			name:     "Auth URL Output",
+			items:    []string{"Acquire::cfd+https::Auth-URL-Output=Status"},
+			expected: func(c *Config) { c.AuthURLOutput = "status" },
+		},
+		{
+			name:   "Bad Auth URL Output",
+			items:  []string{"Acquire::cfd+https::Auth-URL-Output=browser"},
+			errors: true,
+		},
+		{
+			name:     "Auth URL QR",
+			items:    []string{"Acquire::cfd+https::Auth-URL-QR=TTY"},
+			expected: func(c *Config) { c.AuthURLQR = "tty" },
+		},
+		{
+			name:     "No Auth URL QR",
+			items:    []string{"Acquire::cfd+https::Auth-URL-QR=tty", "Acquire::cfd+https::Auth-URL-QR=false"},
+			expected: func(c *Config) { c.AuthURLQR = "none" },
+		},
+		{
+			name:   "Bad Auth URL QR",
+			items:  []string{"Acquire::cfd+https::Auth-URL-QR=true"},
+			errors: true,
+		},
+		{
+			name:   "Auth URL QR In Status",
+			items:  []string{"Acquire::cfd+https::Auth-URL-QR=status"},
+			errors: true,
+		},
+		{
+			name: "Token Validation",
+			items: []string{
+				"Acquire::cfd+https::Team-Domain=Example.cloudflareaccess.com",
+				"Acquire::cfd+https::Audience=4714c1358e65fe4b408ad6d432a5f878f08194bdb4752441fd56faefa9b2b6f2",
+				"Acquire::cfd+https::Verify-Signature=yes",
+				"Acquire::cfd+https::Certs-Cache-Dir=/var/cache/apt/cfd+https",
+			},
+			expected: func(c *Config) {
+				c.TeamDomain = "example.cloudflareaccess.com"
+				c.Audience = "4714c1358e65fe4b408ad6d432a5f878f08194bdb4752441fd56faefa9b2b6f2"
+				c.VerifySignature = true
+				c.CertsCacheDir = "/var/cache/apt/cfd+https"
+			},
+		},
+		{
+			name:     "Team Domain URL",
+			items:    []string{"Acquire::cfd+https::Team-Domain=https://example.cloudflareaccess.com/"},
+			expected: func(c *Config) { c.TeamDomain = "example.cloudflareaccess.com" },
+		},
+		{
+			name:   "Bad Team Domain",
+			items:  []string{"Acquire::cfd+https::Team-Domain=http://example.cloudflareaccess.com"},
+			errors: true,
+		},
+		{
+			name:   "Team Domain Path",
+			items:  []string{"Acquire::cfd+https::Team-Domain=example.cloudflareaccess.com/cdn-cgi"},
+			errors: true,
+		},
+		{
+			name:     "Show Identity",
+			items:    []string{"Acquire::cfd+https::Show-Identity=false"},
+			expected: func(c *Config) { c.ShowIdentity = false },
+		},
+		{
+			name:     "Last Value Wins",
+			items:    []string{"Acquire::cfd+https::Retries=3", "Acquire::cfd+https::Retries=5"},
+			expected: func(c *Config) { c.Retries = 5 },
+		},
+		{
+			name:     "Host Override",
+			items:    []string{"Acquire::cfd+https::repo.example.com::Timeout=10"},
+			expected: func(c *Config) {},
+		},
+		{
+			name:   "Bad Host Override",
+			items:  []string{"Acquire::cfd+https::repo.example.com::Timeout=never"},
+			errors: true,
+		},
+		{
+			name:   "Host Workers",
+			items:  []string{"Acquire::cfd+https::repo.example.com::Workers=2"},
+			errors: true,
+		},
+		{
+			name:   "Host Certs Cache Dir",
+			items:  []string{"Acquire::cfd+https::repo.example.com::Certs-Cache-Dir=/tmp"},
+			errors: true,
+		},
+		{
+			name:   "Host Auth URL Output",
+			items:  []string{"Acquire::cfd+https::repo.example.com::Auth-URL-Output=stderr"},
+			errors: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			var err error
+			for _, item := range test.items {
+				if err = config.Set(item); err != nil {
+					break
+				}
+			}
+
+			if test.errors {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := NewConfig()
+			test.expected(expected)
+			expected.hosts = config.hosts
+			assert.Equal(t, expected, config)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []string
+		err   string
+	}{
+		{
+			name: "Defaults",
+		},
+		{
+			name: "Verify Signature",
+			items: []string{
+				"Acquire::cfd+https::Verify-Signature=true",
+				"Acquire::cfd+https::Team-Domain=example.cloudflareaccess.com",
+			},
+		},
+		{
+			name:  "Verify Signature Without Team Domain",
+			items: []string{"Acquire::cfd+https::Verify-Signature=true"},
+			err: "Acquire::cfd+https::Verify-Signature requires " +
+				"Acquire::cfd+https::Team-Domain to be set",
+		},
+		{
+			name: "Host Team Domain",
+			items: []string{
+				"Acquire::cfd+https::repo.example.com::Verify-Signature=true",
+				"Acquire::cfd+https::repo.example.com::Team-Domain=example.cloudflareaccess.com",
+			},
+		},
+		{
+			name: "Host Without Team Domain",
+			items: []string{
+				"Acquire::cfd+https::Verify-Signature=true",
+				"Acquire::cfd+https::Team-Domain=example.cloudflareaccess.com",
+				"Acquire::cfd+https::repo.example.com::Team-Domain=",
+			},
+			err: "Acquire::cfd+https::Verify-Signature requires " +
+				"Acquire::cfd+https::Team-Domain to be set for repo.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			for _, item := range test.items {
+				require.NoError(t, config.Set(item))
+			}
+
+			err := config.Validate()
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
+
+func TestConfigForHost(t *testing.T) {
+	config := NewConfig()
+	items := []string{
+		"Acquire::cfd+https::Timeout=30",
+		"Acquire::cfd+https::Retries=2",
+		"Acquire::cfd+https::Repo.Example.com::Timeout=90",
+		"Acquire::cfd+https::repo.example.com::Proxy=http://proxy.example.com:3128",
+		"Acquire::cfd+https::repo.example.com:8443::Retries=0",
+		"Acquire::cfd+https::other.example.com::Service-Token-Dir=/etc/other",
+	}
+	for _, item := range items {
+		require.NoError(t, config.Set(item))
+	}
+
+	tests := []struct {
+		host    string
+		timeout time.Duration
+		retries int
+		proxy   string
+		dir     string
+	}{
+		{"unknown.example.com", 30 * time.Second, 2, "", ""},
+		{"repo.example.com", 90 * time.Second, 2, "http://proxy.example.com:3128", ""},
+		{"REPO.example.com:443", 90 * time.Second, 2, "http://proxy.example.com:3128", ""},
+		{"repo.example.com:8443", 90 * time.Second, 0, "http://proxy.example.com:3128", ""},
+		{"other.example.com", 30 * time.Second, 2, "", "/etc/other"},
+	}
+
+	for _, test := range tests {
+		cfg := config.ForHost(test.host)
+		assert.Equal(t, test.timeout, cfg.Timeout, test.host)
+		assert.Equal(t, test.retries, cfg.Retries, test.host)
+		assert.Equal(t, test.proxy, cfg.Proxy, test.host)
+		assert.Equal(t, test.dir, cfg.ServiceTokenDir, test.host)
+	}
+
+	// Overrides don't leak into the global settings
+	assert.Equal(t, 30*time.Second, config.Timeout)
+	assert.Equal(t, "", config.Proxy)
+}
@@ -0,0 +1,218 @@
+package apt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxRetryDelay caps the exponential backoff between retries.
+	maxRetryDelay = 30 * time.Second
+
+	// maxRetryAfter is the longest Retry-After the method will wait for. If
+	// a server asks for a longer wait, the failure is left for apt to retry.
+	maxRetryAfter = 2 * time.Minute
+)
+
+// AuthError is returned by Acquire when the method can't authenticate with
+// Access, either because no token could be found or because Access rejected
+// the request even after getting a fresh token.
+type AuthError struct {
+	URI string
+
+	// Reason describes why authentication failed.
+	Reason string
+
+	// AuthURL is where the user can log in, if known.
+	AuthURL string
+
+	// AppURL is the application, which the user can open in a browser to
+	// log in, if the login page itself isn't known.
+	AppURL string
+}
+
+func (e *AuthError) Error() string {
+	msg := fmt.Sprintf("authentication failed for %s: %s", e.URI, e.Reason)
+	if e.AuthURL != "" {
+		msg += "; log in at " + e.AuthURL
+	} else if e.AppURL != "" {
+		msg += "; open " + e.AppURL + " in a browser to log in"
+	}
+	return msg
+}
+
+// URIFailure is an error which describes how a failed acquire is reported to
+// apt in a '400 URI Failure' message.
+//
+// The FailReason values match the ones apt's own http method uses, so that
+// apt handles the failure the same way.
+type URIFailure struct {
+	Err error
+
+	// Reason is the FailReason reported to apt, e.g. "Timeout" or
+	// "HttpError404". It may be "" if there is no more specific reason.
+	Reason string
+
+	// Transient is true if the request may succeed if it is retried.
+	Transient bool
+
+	// RetryAfter is how long the server asked for the request to be delayed
+	// before it is retried, if it did.
+	RetryAfter time.Duration
+
+	// Fields are extra fields added to the failure message, such as the
+	// hashes of a file which didn't match the expected hashes.
+	Fields []Field
+}
+
+func (f *URIFailure) Error() string {
+	return f.Err.Error()
+}
+
+// readError is returned when reading the body of a response fails part way
+// through, which leaves a partial file that can be resumed.
+type readError struct {
+	Err error
+}
+
+func (e *readError) Error() string {
+	return "error reading response body: " + e.Err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError works out how the error from a failed acquire is reported.
+func classifyError(err error) *URIFailure {
+	var failure *URIFailure
+	if errors.As(err, &failure) {
+		return failure
+	}
+
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return &URIFailure{Err: err, Reason: "AuthFailure"}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return &URIFailure{Err: err, Reason: "ResolveFailure"}
+		}
+		return &URIFailure{Err: err, Reason: "TmpResolveFailure", Transient: true}
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return &URIFailure{Err: err, Reason: "ConnectionRefused", Transient: true}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &URIFailure{Err: err, Reason: "Timeout", Transient: true}
+	}
+
+	var opErr *net.OpError
+	var readErr *readError
+	if errors.As(err, &opErr) || errors.Is(err, syscall.ECONNRESET) || errors.As(err, &readErr) {
+		return &URIFailure{Err: err, Reason: "ConnectionFailed", Transient: true}
+	}
+
+	return &URIFailure{Err: err}
+}
+
+// maximumSizeExceeded returns the failure for a download which is larger than
+// the Maximum-Size apt asked for.
+func maximumSizeExceeded(max int64) *URIFailure {
+	return &URIFailure{
+		Err:    fmt.Errorf("file is larger than the maximum size of %d bytes", max),
+		Reason: "MaximumSizeExceeded",
+	}
+}
+
+// isFailureStatus reports whether the status of a response means the acquire
+// failed.
+//
+// A 416 isn't a failure, as it may mean a partial download is complete.
+func isFailureStatus(status int) bool {
+	return status >= 400 && status != http.StatusRequestedRangeNotSatisfiable
+}
+
+// classifyResponse works out how an unsuccessful response is reported.
+//
+// Server errors and rate limiting are transient. Other errors, such as a 404,
+// are permanent.
+func classifyResponse(uri string, resp *http.Response) *URIFailure {
+	failure := &URIFailure{
+		Err:    fmt.Errorf("GET for %s failed with %s", uri, resp.Status),
+		Reason: fmt.Sprintf("HttpError%d", resp.StatusCode),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		failure.Transient = true
+		failure.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		failure.Transient = true
+		failure.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode >= 500:
+		failure.Transient = true
+	}
+	return failure
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(when); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// retryDelay returns how long to wait before the given retry (starting at 0).
+//
+// The delay doubles with each retry, up to maxRetryDelay, and is randomized
+// so that parallel downloads don't retry in lockstep. If the server asked for
+// a longer delay with Retry-After, that is used instead. ok is false if the
+// server asked for a delay which is too long to wait for.
+func retryDelay(base time.Duration, attempt int, retryAfter time.Duration) (delay time.Duration, ok bool) {
+	if retryAfter > maxRetryAfter {
+		return 0, false
+	}
+
+	delay = maxRetryDelay
+	if attempt < 16 && base<<uint(attempt) < maxRetryDelay {
+		delay = base << uint(attempt)
+	}
+
+	// Equal jitter: wait for a random time between half the delay and all of it
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1)) // #nosec
+	}
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay, true
+}
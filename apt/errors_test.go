@@ -0,0 +1,178 @@
+package apt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		reason    string
+		transient bool
+	}{
+		{
+			name:   "Auth Failure",
+			err:    &AuthError{URI: "https://example.com/", Reason: "no token"},
+			reason: "AuthFailure",
+		},
+		{
+			name:   "Unknown Host",
+			err:    fmt.Errorf("get: %w", &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}),
+			reason: "ResolveFailure",
+		},
+		{
+			name:      "Resolver Failure",
+			err:       &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true},
+			reason:    "TmpResolveFailure",
+			transient: true,
+		},
+		{
+			name: "Connection Refused",
+			err: &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{
+				Syscall: "connect", Err: syscall.ECONNREFUSED,
+			}},
+			reason:    "ConnectionRefused",
+			transient: true,
+		},
+		{
+			name:      "Connection Reset",
+			err:       &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+			reason:    "ConnectionFailed",
+			transient: true,
+		},
+		{
+			name:      "Timeout",
+			err:       fmt.Errorf("get: %w", context.DeadlineExceeded),
+			reason:    "Timeout",
+			transient: true,
+		},
+		{
+			name:      "Body Cut Short",
+			err:       &readError{Err: io.ErrUnexpectedEOF},
+			reason:    "ConnectionFailed",
+			transient: true,
+		},
+		{
+			name: "Other",
+			err:  errors.New("error opening file"),
+		},
+		{
+			name:      "Failure",
+			err:       &URIFailure{Err: errors.New("failed"), Reason: "HttpError500", Transient: true},
+			reason:    "HttpError500",
+			transient: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failure := classifyError(test.err)
+			assert.Equal(t, test.reason, failure.Reason)
+			assert.Equal(t, test.transient, failure.Transient)
+			assert.Equal(t, test.err.Error(), failure.Error())
+		})
+	}
+}
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		transient  bool
+		delay      time.Duration
+	}{
+		{name: "Not Found", status: http.StatusNotFound},
+		{name: "Forbidden", status: http.StatusForbidden},
+		{name: "Server Error", status: http.StatusInternalServerError, transient: true},
+		{name: "Bad Gateway", status: http.StatusBadGateway, transient: true},
+		{
+			name:       "Unavailable",
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "120",
+			transient:  true,
+			delay:      2 * time.Minute,
+		},
+		{
+			name:       "Too Many Requests",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "5",
+			transient:  true,
+			delay:      5 * time.Second,
+		},
+		{
+			name:       "Bad Retry-After",
+			status:     http.StatusTooManyRequests,
+			retryAfter: "soon",
+			transient:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: test.status,
+				Status:     fmt.Sprintf("%d %s", test.status, http.StatusText(test.status)),
+				Header:     make(http.Header),
+			}
+			if test.retryAfter != "" {
+				resp.Header.Set("Retry-After", test.retryAfter)
+			}
+
+			failure := classifyResponse("https://example.com/pkg.deb", resp)
+			assert.Equal(t, fmt.Sprintf("HttpError%d", test.status), failure.Reason)
+			assert.Equal(t, test.transient, failure.Transient)
+			assert.Equal(t, test.delay, failure.RetryAfter)
+			assert.Contains(t, failure.Error(), resp.Status)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1"))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	delay := parseRetryAfter(date)
+	assert.True(t, delay > 59*time.Minute && delay <= time.Hour, "delay %v", delay)
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	assert.Equal(t, time.Duration(0), parseRetryAfter(past))
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		delay, ok := retryDelay(time.Second, attempt, 0)
+		assert.True(t, ok)
+
+		max := maxRetryDelay
+		if attempt < 5 {
+			max = time.Second << uint(attempt)
+		}
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d: delay %v", attempt, delay)
+	}
+
+	delay, ok := retryDelay(time.Second, 0, 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, delay)
+
+	_, ok = retryDelay(time.Second, 0, time.Hour)
+	assert.False(t, ok)
+
+	delay, ok = retryDelay(0, 3, 0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+}
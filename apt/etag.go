@@ -0,0 +1,113 @@
+package apt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// etagStore remembers the ETags of downloaded resources, keyed by URI, so
+// that later requests can be made conditional on them.
+//
+// Each ETag is stored with the Last-Modified time of the same response, so
+// that it is only used for the copy of the resource it belongs to. Apt keeps
+// its own copy, and tells the method its Last-Modified time, but not its
+// ETag.
+//
+// If the store has a path, the ETags are loaded from and saved to that file
+// so that they are remembered between runs.
+type etagStore struct {
+	mu    sync.Mutex
+	path  string
+	etags map[string]storedETag
+}
+
+// storedETag is an ETag and the Last-Modified time sent with it.
+type storedETag struct {
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// loadETagStore creates an etagStore backed by the given file, which may be
+// "" to only keep ETags in memory.
+//
+// A missing or unreadable file results in an empty store, as the ETags are
+// only an optimization.
+func loadETagStore(path string) *etagStore {
+	store := &etagStore{
+		path:  path,
+		etags: make(map[string]storedETag),
+	}
+
+	if path == "" {
+		return store
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return store
+	}
+
+	if err := json.Unmarshal(data, &store.etags); err != nil {
+		store.etags = make(map[string]storedETag)
+	}
+	return store
+}
+
+// Get returns the ETag for the copy of the URI last modified at
+// lastModified, or "" if it isn't known.
+func (s *etagStore) Get(uri string, lastModified time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.etags[uri]
+	if !ok || lastModified.IsZero() || !stored.LastModified.Equal(lastModified) {
+		return ""
+	}
+	return stored.ETag
+}
+
+// Set records the ETag and Last-Modified time for the URI, and saves the
+// store if it has a path.
+func (s *etagStore) Set(uri, etag string, lastModified time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := storedETag{ETag: etag, LastModified: lastModified.UTC()}
+	if old, ok := s.etags[uri]; ok && old.ETag == etag && old.LastModified.Equal(lastModified) {
+		return nil
+	}
+	s.etags[uri] = stored
+
+	if s.path == "" {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store to its file. The file is replaced atomically so that
+// a crash can't leave it half written. The caller must hold s.mu.
+func (s *etagStore) save() error {
+	data, err := json.Marshal(s.etags)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,61 @@
+package apt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETagStore(t *testing.T) {
+	modtime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Memory", func(t *testing.T) {
+		store := loadETagStore("")
+		assert.Equal(t, "", store.Get("cfd+https://repo.example.com/InRelease", modtime))
+		require.NoError(t, store.Set("cfd+https://repo.example.com/InRelease", `"abc"`, modtime))
+		assert.Equal(t, `"abc"`, store.Get("cfd+https://repo.example.com/InRelease", modtime))
+		assert.Equal(t, `"abc"`, store.Get("cfd+https://repo.example.com/InRelease", modtime.In(time.Local)))
+
+		// The ETag isn't used for other copies of the resource
+		assert.Equal(t, "", store.Get("cfd+https://repo.example.com/InRelease", modtime.Add(-time.Hour)))
+		assert.Equal(t, "", store.Get("cfd+https://repo.example.com/InRelease", time.Time{}))
+	})
+
+	t.Run("File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cfd-etag-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "etags")
+		store := loadETagStore(path)
+		require.NoError(t, store.Set("cfd+https://repo.example.com/InRelease", `"abc"`, modtime))
+		require.NoError(t, store.Set("cfd+https://repo.example.com/Packages", `W/"def"`, modtime.Add(time.Hour)))
+
+		store = loadETagStore(path)
+		assert.Equal(t, `"abc"`, store.Get("cfd+https://repo.example.com/InRelease", modtime))
+		assert.Equal(t, `W/"def"`, store.Get("cfd+https://repo.example.com/Packages", modtime.Add(time.Hour)))
+		assert.Equal(t, "", store.Get("cfd+https://repo.example.com/Packages", modtime))
+
+		// Temporary files are cleaned up
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("Corrupt File", func(t *testing.T) {
+		file, err := ioutil.TempFile("", "cfd-etag-test")
+		require.NoError(t, err)
+		defer os.Remove(file.Name())
+		file.WriteString("not json")
+		file.Close()
+
+		store := loadETagStore(file.Name())
+		assert.Equal(t, "", store.Get("cfd+https://repo.example.com/InRelease", modtime))
+		require.NoError(t, store.Set("cfd+https://repo.example.com/InRelease", `"abc"`, modtime))
+	})
+}
@@ -11,6 +11,10 @@ import (
 type CmdBuilder interface {
 	Command(cmd string, args ...string) *osexec.Cmd
 	CommandContext(ctx context.Context, cmd string, args ...string) *osexec.Cmd
+
+	// CommandAsContext is like CommandContext, but the command runs as the
+	// given user if u isn't nil. See the CommandAsContext function.
+	CommandAsContext(ctx context.Context, u *User, cmd string, args ...string) *osexec.Cmd
 }
 
 var (
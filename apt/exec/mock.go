@@ -20,6 +20,9 @@ type MockEntry struct {
 	// Output is a string to write to os.Stdout
 	Output string
 
+	// Stderr is a string to write to os.Stderr
+	Stderr string
+
 	// Extra is an array of extra environment variables to pass.
 	Extra []string
 }
@@ -41,6 +44,10 @@ func (me *MockEntry) GetEnvVars() []string {
 
 	s = append(s, "MOCK_EXEC_OUTPUT="+me.Output)
 
+	if me.Stderr != "" {
+		s = append(s, "MOCK_EXEC_STDERR="+me.Stderr)
+	}
+
 	if len(me.Extra) > 0 {
 		s = append(s, me.Extra...)
 	}
@@ -48,11 +55,25 @@ func (me *MockEntry) GetEnvVars() []string {
 	return s
 }
 
+// MockCall records a command built by a MockBuilder.
+type MockCall struct {
+	// Cmd and Args are the command and arguments which would have been run.
+	Cmd  string
+	Args []string
+
+	// User is who the command would have run as, or nil for the current
+	// user.
+	User *User
+}
+
 // MockBuilder is a CmdBuilder which builds test Cmd instances.
 type MockBuilder struct {
 	Index   int
 	Entries []MockEntry
 	Helper  string
+
+	// Calls records every command built, in order.
+	Calls []MockCall
 }
 
 // NewMockBuilder creates a new builder which creates mock Commands.
@@ -70,6 +91,14 @@ func (mb *MockBuilder) Command(cmd string, args ...string) *osexec.Cmd {
 
 // CommandContext returns a test command with the given context.
 func (mb *MockBuilder) CommandContext(ctx context.Context, cmd string, args ...string) *osexec.Cmd {
+	return mb.CommandAsContext(ctx, nil, cmd, args...)
+}
+
+// CommandAsContext returns a test command with the given context. The user
+// is recorded in Calls, but the command runs as the current user.
+func (mb *MockBuilder) CommandAsContext(ctx context.Context, u *User, cmd string, args ...string) *osexec.Cmd {
+	mb.Calls = append(mb.Calls, MockCall{Cmd: cmd, Args: args, User: u})
+
 	cs := []string{"-test.run=" + mb.Helper, "--", "cmd"}
 	cs = append(cs, args...)
 
@@ -86,10 +115,12 @@ func (mb *MockBuilder) CommandContext(ctx context.Context, cmd string, args ...s
 	return command
 }
 
-// Reset sets the index of the MockBuilder to 0 and changes the entry list.
+// Reset sets the index of the MockBuilder to 0, changes the entry list and
+// forgets the recorded calls.
 func (mb *MockBuilder) Reset(entries ...MockEntry) {
 	mb.Index = 0
 	mb.Entries = entries
+	mb.Calls = nil
 }
 
 // MockExecHelper implements the logic for the helper process.
@@ -104,7 +135,7 @@ func MockExecHelper() {
 
 	sleepstr := os.Getenv("MOCK_EXEC_SLEEP")
 	if sleepstr != "" {
-		dur, err := strconv.ParseInt(sleepstr, 10, 32)
+		dur, err := strconv.ParseInt(sleepstr, 10, 64)
 		if err == nil && dur > 0 {
 			time.Sleep(time.Duration(dur))
 		}
@@ -115,6 +146,11 @@ func MockExecHelper() {
 		fmt.Print(out)
 	}
 
+	errout := os.Getenv("MOCK_EXEC_STDERR")
+	if errout != "" {
+		fmt.Fprint(os.Stderr, errout)
+	}
+
 	var exitcode int64
 	ecs := os.Getenv("MOCK_EXEC_EXIT_CODE")
 	if ecs != "" {
@@ -19,3 +19,9 @@ func (rb realbuilder) Command(cmd string, args ...string) *osexec.Cmd {
 func (rb realbuilder) CommandContext(ctx context.Context, cmd string, args ...string) *osexec.Cmd {
 	return osexec.CommandContext(ctx, cmd, args...)
 }
+
+func (rb realbuilder) CommandAsContext(ctx context.Context, u *User, cmd string, args ...string) *osexec.Cmd {
+	command := osexec.CommandContext(ctx, cmd, args...)
+	commandAs(command, u)
+	return command
+}
@@ -0,0 +1,152 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// User is a user commands can be run as.
+type User struct {
+	Username string
+	UID      uint32
+	GID      uint32
+	Groups   []uint32
+	HomeDir  string
+}
+
+// invokingUserVars are the environment variables which name the user who ran
+// the current process through sudo, pkexec or doas, in the order they are
+// checked. Variables holding a uid are preferred, as they can't be ambiguous.
+var invokingUserVars = []struct {
+	name  string
+	isUID bool
+}{
+	{"SUDO_UID", true},
+	{"SUDO_USER", false},
+	{"PKEXEC_UID", true},
+	{"DOAS_USER", false},
+}
+
+// InvokingUser returns the user who ran the current process with sudo, pkexec
+// or doas, or nil if there is no such user, or it is the current user.
+func InvokingUser() (*User, error) {
+	for _, v := range invokingUserVars {
+		value := strings.TrimSpace(os.Getenv(v.name))
+		if value == "" {
+			continue
+		}
+
+		var u *user.User
+		var err error
+		if v.isUID {
+			u, err = user.LookupId(value)
+		} else {
+			u, err = user.Lookup(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the user in %s: %v", v.name, err)
+		}
+
+		if u.Uid == strconv.Itoa(os.Getuid()) {
+			return nil, nil
+		}
+		return newUser(u)
+	}
+	return nil, nil
+}
+
+// newUser converts a user from os/user.
+func newUser(u *user.User) (*User, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has an invalid uid %q", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has an invalid gid %q", u.Username, u.Gid)
+	}
+
+	ru := &User{
+		Username: u.Username,
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		HomeDir:  u.HomeDir,
+	}
+
+	// The supplementary groups are best effort, as not every platform can
+	// list them
+	groups, _ := u.GroupIds()
+	for _, group := range groups {
+		if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+			ru.Groups = append(ru.Groups, uint32(gid))
+		}
+	}
+	return ru, nil
+}
+
+// userEnvVars are replaced or removed from the environment of commands run as
+// another user, as they describe the current user.
+var userEnvVars = []string{
+	"HOME", "USER", "LOGNAME", "XDG_CONFIG_HOME", "XDG_CACHE_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME",
+	"XDG_RUNTIME_DIR", "SUDO_UID", "SUDO_GID", "SUDO_USER", "SUDO_COMMAND", "PKEXEC_UID", "DOAS_USER",
+}
+
+// Environ returns the environment for a command run as the user, given the
+// current environment.
+//
+// HOME, USER and LOGNAME are set for the user, and the XDG base directories
+// are removed so that they default to the user's home directory, except for
+// XDG_RUNTIME_DIR which is set to the user's runtime directory if it exists.
+// The variables naming the invoking user are removed too. Everything else,
+// e.g. DISPLAY for opening a browser, is kept.
+func (u *User) Environ(environ []string) []string {
+	env := make([]string, 0, len(environ)+4)
+	for _, kv := range environ {
+		if !isUserEnvVar(kv) {
+			env = append(env, kv)
+		}
+	}
+
+	env = append(env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	runtime := filepath.Join("/run/user", strconv.FormatUint(uint64(u.UID), 10))
+	if info, err := os.Stat(runtime); err == nil && info.IsDir() {
+		env = append(env, "XDG_RUNTIME_DIR="+runtime)
+	}
+	return env
+}
+
+// isUserEnvVar reports whether the KEY=VALUE pair is for one of userEnvVars.
+func isUserEnvVar(kv string) bool {
+	for _, name := range userEnvVars {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandAsContext creates a command with the global builder which runs as
+// the given user, with the user's environment. If u is nil, the command runs
+// as the current user.
+//
+// Only root can run commands as another user. Otherwise, e.g. when apt runs
+// the method as its unprivileged _apt user, the command runs as the current
+// user instead.
+func CommandAsContext(ctx context.Context, u *User, cmd string, args ...string) *osexec.Cmd {
+	return Builder.CommandAsContext(ctx, u, cmd, args...)
+}
+
+// commandAs makes cmd run as the user, if the current process can switch
+// users.
+func commandAs(cmd *osexec.Cmd, u *User) {
+	if u == nil || !setCredential(cmd, u) {
+		return
+	}
+	cmd.Env = u.Environ(os.Environ())
+}
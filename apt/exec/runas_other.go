@@ -0,0 +1,13 @@
+//go:build !unix
+
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// setCredential returns false, as commands can't be run as another user on
+// this platform.
+func setCredential(cmd *osexec.Cmd, u *User) bool {
+	return false
+}
@@ -0,0 +1,96 @@
+package exec
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clearInvokingUser unsets the variables InvokingUser looks at.
+func clearInvokingUser(t *testing.T) {
+	for _, v := range invokingUserVars {
+		t.Setenv(v.name, "")
+	}
+}
+
+func TestInvokingUser(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("there is no nobody user")
+	}
+	current := strconv.Itoa(os.Getuid())
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected string
+		errors   bool
+	}{
+		{name: "None"},
+		{name: "Sudo UID", env: map[string]string{"SUDO_UID": nobody.Uid}, expected: "nobody"},
+		{name: "Sudo User", env: map[string]string{"SUDO_USER": "nobody"}, expected: "nobody"},
+		{name: "Pkexec", env: map[string]string{"PKEXEC_UID": nobody.Uid}, expected: "nobody"},
+		{name: "Doas", env: map[string]string{"DOAS_USER": "nobody"}, expected: "nobody"},
+		{
+			name:     "UID Preferred",
+			env:      map[string]string{"SUDO_UID": nobody.Uid, "SUDO_USER": "root"},
+			expected: "nobody",
+		},
+		{name: "Current User", env: map[string]string{"SUDO_UID": current}},
+		{name: "Unknown User", env: map[string]string{"DOAS_USER": "no-such-user-cfd"}, errors: true},
+		{name: "Shell Injection", env: map[string]string{"SUDO_USER": "nobody; rm -rf /"}, errors: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearInvokingUser(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			u, err := InvokingUser()
+			switch {
+			case test.errors:
+				assert.Error(t, err)
+			case test.expected == "":
+				require.NoError(t, err)
+				assert.Nil(t, u)
+			default:
+				require.NoError(t, err)
+				require.NotNil(t, u)
+				assert.Equal(t, test.expected, u.Username)
+				assert.Equal(t, nobody.Uid, strconv.FormatUint(uint64(u.UID), 10))
+				assert.Equal(t, nobody.HomeDir, u.HomeDir)
+			}
+		})
+	}
+}
+
+func TestUserEnviron(t *testing.T) {
+	u := &User{Username: "alice", UID: 4294967294, HomeDir: "/home/alice"}
+	env := u.Environ([]string{
+		"PATH=/usr/bin:/bin",
+		"HOME=/root",
+		"USER=root",
+		"LOGNAME=root",
+		"DISPLAY=:0",
+		"XDG_CONFIG_HOME=/root/.config",
+		"XDG_RUNTIME_DIR=/run/user/0",
+		"SUDO_USER=alice",
+		"SUDO_UID=1000",
+		"HOMEPAGE=https://example.com",
+	})
+
+	assert.Equal(t, []string{
+		"PATH=/usr/bin:/bin",
+		"DISPLAY=:0",
+		"HOMEPAGE=https://example.com",
+		"HOME=/home/alice",
+		"USER=alice",
+		"LOGNAME=alice",
+	}, env)
+}
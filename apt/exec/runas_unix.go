@@ -0,0 +1,27 @@
+//go:build unix
+
+package exec
+
+import (
+	"os"
+	osexec "os/exec"
+	"syscall"
+)
+
+// setCredential makes cmd run as the user. It returns false if the current
+// process isn't root, and so can't.
+func setCredential(cmd *osexec.Cmd, u *User) bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    u.UID,
+		Gid:    u.GID,
+		Groups: u.Groups,
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package exec
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandAsContext(t *testing.T) {
+	u := &User{Username: "alice", UID: 1000, GID: 1000, HomeDir: "/home/alice"}
+
+	cmd := RealBuilder().CommandAsContext(context.Background(), u, "cloudflared", "access", "login")
+	assert.Equal(t, []string{"cloudflared", "access", "login"}, cmd.Args)
+	if os.Geteuid() == 0 {
+		require.NotNil(t, cmd.SysProcAttr)
+		require.NotNil(t, cmd.SysProcAttr.Credential)
+		assert.Equal(t, uint32(1000), cmd.SysProcAttr.Credential.Uid)
+		assert.Contains(t, cmd.Env, "HOME=/home/alice")
+	} else {
+		// Only root can switch users, so the command runs as the current user
+		assert.Nil(t, cmd.SysProcAttr)
+		assert.Nil(t, cmd.Env)
+	}
+
+	cmd = RealBuilder().CommandAsContext(context.Background(), nil, "cloudflared")
+	assert.Nil(t, cmd.SysProcAttr)
+	assert.Nil(t, cmd.Env)
+}
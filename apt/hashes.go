@@ -0,0 +1,81 @@
+package apt
+
+import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// expectedHashFields maps the 'Expected-*' fields of a '600 URI Acquire'
+// message to the fields the hashes are reported in.
+var expectedHashFields = map[string]string{
+	"expected-md5sum": "MD5Sum-Hash",
+	"expected-sha1":   "SHA1-Hash",
+	"expected-sha256": "SHA256-Hash",
+	"expected-sha512": "SHA512-Hash",
+}
+
+// hashes computes every hash apt may check a downloaded file against.
+type hashes struct {
+	md5    hash.Hash
+	sha1   hash.Hash
+	sha256 hash.Hash
+	sha512 hash.Hash
+}
+
+// newHashes creates a set of hashes with nothing written to them.
+func newHashes() *hashes {
+	return &hashes{
+		md5:    md5.New(),  // #nosec
+		sha1:   sha1.New(), // #nosec
+		sha256: sha256.New(),
+		sha512: sha512.New(),
+	}
+}
+
+// Write implements the io.Writer interface, writing data to every hash.
+func (h *hashes) Write(data []byte) (int, error) {
+	// hash.Hash never returns an error from Write
+	h.md5.Write(data)
+	h.sha1.Write(data)
+	h.sha256.Write(data)
+	h.sha512.Write(data)
+	return len(data), nil
+}
+
+// Fields returns the hashes as the fields of a '201 URI Done' message.
+func (h *hashes) Fields() []Field {
+	strMD5 := fmt.Sprintf("%x", h.md5.Sum(nil))
+	return []Field{
+		{"MD5-Hash", strMD5},
+		{"MD5Sum-Hash", strMD5},
+		{"SHA1-Hash", fmt.Sprintf("%x", h.sha1.Sum(nil))},
+		{"SHA256-Hash", fmt.Sprintf("%x", h.sha256.Sum(nil))},
+		{"SHA512-Hash", fmt.Sprintf("%x", h.sha512.Sum(nil))},
+	}
+}
+
+// Verify checks the hashes against the 'Expected-*' fields of a '600 URI
+// Acquire' message, returning an error for the first one which doesn't match.
+//
+// Fields for hashes which aren't computed are ignored.
+func (h *hashes) Verify(expected []Field) error {
+	fields := h.Fields()
+	for _, exp := range expected {
+		name, ok := expectedHashFields[strings.ToLower(exp.Key)]
+		if !ok {
+			continue
+		}
+
+		for _, field := range fields {
+			if field.Key == name && !strings.EqualFold(field.Value, exp.Value) {
+				return fmt.Errorf("%s is %s, expected %s", strings.TrimSuffix(name, "-Hash"), field.Value, exp.Value)
+			}
+		}
+	}
+	return nil
+}
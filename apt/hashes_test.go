@@ -0,0 +1,53 @@
+package apt
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashes(t *testing.T) {
+	sums := newHashes()
+	io.Copy(sums, strings.NewReader("a"))
+	io.Copy(sums, strings.NewReader("bc"))
+
+	assert.Equal(t, []Field{
+		{"MD5-Hash", "900150983cd24fb0d6963f7d28e17f72"},
+		{"MD5Sum-Hash", "900150983cd24fb0d6963f7d28e17f72"},
+		{"SHA1-Hash", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"SHA256-Hash", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"SHA512-Hash", "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a" +
+			"2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	}, sums.Fields())
+}
+
+func TestHashesVerify(t *testing.T) {
+	sums := newHashes()
+	io.WriteString(sums, "abc")
+
+	sha256 := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	tests := []struct {
+		name     string
+		expected []Field
+		errors   bool
+	}{
+		{"None", nil, false},
+		{"Match", []Field{{"Expected-SHA256", sha256}}, false},
+		{"Upper Case", []Field{{"Expected-SHA256", strings.ToUpper(sha256)}}, false},
+		{"Mismatch", []Field{{"Expected-SHA256", sha256}, {"Expected-MD5Sum", "0000"}}, true},
+		{"Unknown Hash", []Field{{"Expected-SHA3", "0000"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := sums.Verify(test.expected)
+			if test.errors {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
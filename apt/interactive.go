@@ -0,0 +1,68 @@
+package apt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// InteractiveMode says whether the method may ask the user to log in.
+type InteractiveMode int
+
+const (
+	// InteractiveAuto logs the user in only if someone appears to be there
+	// to do it; see isInteractive.
+	InteractiveAuto InteractiveMode = iota
+
+	// InteractiveOn always lets the user log in.
+	InteractiveOn
+
+	// InteractiveOff never lets the user log in, so only tokens which can
+	// be found without them are used.
+	InteractiveOff
+)
+
+// stderrIsTerminal reports whether the method's standard error, which apt
+// passes through from its own, is a terminal. It is a variable so that tests
+// can replace it.
+var stderrIsTerminal = func() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Enabled reports whether the user may be asked to log in.
+//
+// In the auto mode, logging in is disabled if apt isn't attached to a
+// terminal, or the environment says nobody is there to answer, with
+// DEBIAN_FRONTEND=noninteractive or APT_LISTCHANGES_FRONTEND=none. Otherwise
+// 'cloudflared access login' would wait for a browser until it times out.
+func (m InteractiveMode) Enabled() bool {
+	switch m {
+	case InteractiveOn:
+		return true
+	case InteractiveOff:
+		return false
+	}
+
+	if os.Getenv("DEBIAN_FRONTEND") == "noninteractive" || os.Getenv("APT_LISTCHANGES_FRONTEND") == "none" {
+		return false
+	}
+	return stderrIsTerminal()
+}
+
+// parseInteractive parses an Interactive setting, which is either "auto" or a
+// boolean.
+func parseInteractive(value string) (InteractiveMode, error) {
+	if value == "" || strings.EqualFold(value, "auto") {
+		return InteractiveAuto, nil
+	}
+
+	on, err := parseBool(value)
+	if err != nil {
+		return InteractiveAuto, fmt.Errorf("%q is neither \"auto\" nor a boolean", value)
+	}
+	if on {
+		return InteractiveOn, nil
+	}
+	return InteractiveOff, nil
+}
@@ -0,0 +1,60 @@
+package apt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteractiveModeEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     InteractiveMode
+		terminal bool
+		env      map[string]string
+		expected bool
+	}{
+		{name: "Terminal", terminal: true, expected: true},
+		{name: "No Terminal"},
+		{
+			name:     "Debian Frontend",
+			terminal: true,
+			env:      map[string]string{"DEBIAN_FRONTEND": "noninteractive"},
+		},
+		{
+			name:     "Listchanges Frontend",
+			terminal: true,
+			env:      map[string]string{"APT_LISTCHANGES_FRONTEND": "none"},
+		},
+		{
+			name:     "Other Frontend",
+			terminal: true,
+			env:      map[string]string{"DEBIAN_FRONTEND": "readline"},
+			expected: true,
+		},
+		{name: "On", mode: InteractiveOn, expected: true},
+		{
+			name:     "On Despite Environment",
+			mode:     InteractiveOn,
+			env:      map[string]string{"DEBIAN_FRONTEND": "noninteractive"},
+			expected: true,
+		},
+		{name: "Off", mode: InteractiveOff, terminal: true},
+	}
+
+	defer func(orig func() bool) { stderrIsTerminal = orig }(stderrIsTerminal)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEBIAN_FRONTEND", "")
+			t.Setenv("APT_LISTCHANGES_FRONTEND", "")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			terminal := test.terminal
+			stderrIsTerminal = func() bool { return terminal }
+
+			assert.Equal(t, test.expected, test.mode.Enabled())
+		})
+	}
+}
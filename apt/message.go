@@ -7,6 +7,8 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 // CapFlags represents a set of Apt Capabilities.
@@ -40,10 +42,13 @@ const (
 )
 
 // Message represents a generic message as read from os.Stdin.
+//
+// Fields are kept in the order they were read or added, and a key may appear
+// more than once (e.g. 'Config-Item' in a '601 Configuration' message).
 type Message struct {
 	StatusCode  uint64
 	Description string
-	Fields      map[string]string
+	Fields      []Field
 }
 
 // Field represents a value field in a mesage.
@@ -54,16 +59,38 @@ type Field struct {
 
 // NewMessage creates a new message with the given fields.
 func NewMessage(statusCode uint64, description string, fields ...Field) *Message {
-	fieldmap := make(map[string]string)
-	for _, field := range fields {
-		fieldmap[field.Key] = field.Value
-	}
-
 	return &Message{
 		statusCode,
 		description,
-		fieldmap,
+		append([]Field(nil), fields...),
+	}
+}
+
+// Get returns the value of the first field with the given key, or "" if
+// there is no such field. Keys are matched case-insensitively, as apt does.
+func (m *Message) Get(key string) string {
+	for _, field := range m.Fields {
+		if strings.EqualFold(field.Key, key) {
+			return field.Value
+		}
 	}
+	return ""
+}
+
+// GetAll returns the values of every field with the given key, in order.
+func (m *Message) GetAll(key string) []string {
+	var values []string
+	for _, field := range m.Fields {
+		if strings.EqualFold(field.Key, key) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a field to the message.
+func (m *Message) Add(key, value string) {
+	m.Fields = append(m.Fields, Field{key, value})
 }
 
 // MessageReader implements an interface for reading messages from an input
@@ -171,7 +198,7 @@ func (r *MessageReader) ReadLine() (*Message, error) {
 	key := strings.TrimSpace(parts[0])
 	value := strings.TrimSpace(parts[1])
 
-	r.message.Fields[key] = value
+	r.message.Add(key, value)
 	return nil, nil
 }
 
@@ -217,7 +244,6 @@ func ParseHeader(line string) (*Message, error) {
 	msg := &Message{
 		StatusCode:  code,
 		Description: desc,
-		Fields:      make(map[string]string),
 	}
 
 	return msg, nil
@@ -232,24 +258,61 @@ func (r *MessageReader) commitMessage(newmsg *Message) *Message {
 }
 
 // MessageWriter is a wrapper around an io.Writer which writes APT messages.
+//
+// A MessageWriter is safe for concurrent use; each message is written to the
+// underlying writer as a single unit, so messages from different goroutines
+// are never interleaved.
 type MessageWriter struct {
-	w io.Writer
+	mu sync.Mutex
+	w  io.Writer
 }
 
 // NewMessageWriter creates a new MessageWriter.
 func NewMessageWriter(w io.Writer) *MessageWriter {
-	return &MessageWriter{w}
+	return &MessageWriter{w: w}
+}
+
+// oneLine returns the value with each run of control characters replaced by
+// a single space, so that it fits on the single line of a message field.
+//
+// Values such as error messages may hold the output of other programs, which
+// can span several lines. A line break would start a new field, and a blank
+// line would end the message early, leaving the rest to be read as another,
+// malformed message.
+func oneLine(value string) string {
+	if strings.IndexFunc(value, unicode.IsControl) < 0 {
+		return value
+	}
+
+	var sb strings.Builder
+	control := false
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			if !control {
+				sb.WriteByte(' ')
+			}
+			control = true
+			continue
+		}
+		control = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
 }
 
 // WriteMessage writes a generic Message object as created by NewMessage.
 //
 // This method is less efficient than the dedicated message functions, as it
-// has to format every part of the message.
+// has to format every part of the message. Fields are written in order, so a
+// message read by a MessageReader is written back out unchanged. Fields with
+// an empty key are skipped.
 func (mw *MessageWriter) WriteMessage(msg *Message) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "%d %s\n", msg.StatusCode, msg.Description)
-	for k, v := range msg.Fields {
-		if k != "" && v != "" {
-			fmt.Fprintf(mw.w, "%s: %s\n", k, v)
+	for _, field := range msg.Fields {
+		if field.Key != "" {
+			fmt.Fprintf(mw.w, "%s: %s\n", field.Key, oneLine(field.Value))
 		}
 	}
 	mw.w.Write([]byte("\n"))
@@ -260,6 +323,8 @@ func (mw *MessageWriter) WriteMessage(msg *Message) {
 // Version must be non-empty. caps may be 0 for no capabilities, though
 // it probably should at least be CapSendConfig (or CapDefault)
 func (mw *MessageWriter) Capabilities(version string, caps CapFlags) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "100 Capabilities\nVersion: %s\n", version)
 	if caps&CapSendConfig != 0 {
 		mw.w.Write([]byte("Send-Config: true\n"))
@@ -287,7 +352,9 @@ func (mw *MessageWriter) Capabilities(version string, caps CapFlags) {
 
 // Log writes a '101 Log' message.
 func (mw *MessageWriter) Log(msg string) {
-	fmt.Fprintf(mw.w, "101 Log\nMessage: %s\n\n", msg)
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	fmt.Fprintf(mw.w, "101 Log\nMessage: %s\n\n", oneLine(msg))
 }
 
 // Logf writes a '101 Log' message and formats the arguments into it.
@@ -297,7 +364,9 @@ func (mw *MessageWriter) Logf(fmtspec string, args ...interface{}) {
 
 // Status writes a '102 status' message.
 func (mw *MessageWriter) Status(msg string) {
-	fmt.Fprintf(mw.w, "102 Status\nMessage: %s\n\n", msg)
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	fmt.Fprintf(mw.w, "102 Status\nMessage: %s\n\n", oneLine(msg))
 }
 
 // Statusf writes a '102 status' message and formats the arguments into if.
@@ -307,6 +376,8 @@ func (mw *MessageWriter) Statusf(fmtspec string, args ...interface{}) {
 
 // Redirect writes a '103 Redirect' message
 func (mw *MessageWriter) Redirect(uri, newURI, altURIs string, usedMirror bool) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "103 Redirect\nURI: %s\nNew-URI: %s\n", uri, newURI)
 	if usedMirror {
 		mw.w.Write([]byte("UsedMirror: true\n"))
@@ -319,7 +390,9 @@ func (mw *MessageWriter) Redirect(uri, newURI, altURIs string, usedMirror bool)
 
 // Warning writes a '104 Warning' message.
 func (mw *MessageWriter) Warning(msg string) {
-	fmt.Fprintf(mw.w, "104 Warning\nMessage: %s\n\n", msg)
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	fmt.Fprintf(mw.w, "104 Warning\nMessage: %s\n\n", oneLine(msg))
 }
 
 // Warningf writes a '104 Warning' message and formats the arguments into it.
@@ -329,6 +402,8 @@ func (mw *MessageWriter) Warningf(fmtspec string, args ...interface{}) {
 
 // StartURI writes a '200 URI Start' message.
 func (mw *MessageWriter) StartURI(uri, resumePoint string, size int64, usedMirror bool) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "200 URI Start\nURI: %s\n", uri)
 	if resumePoint != "" {
 		fmt.Fprintf(mw.w, "Resume-Point: %s\n", resumePoint)
@@ -345,6 +420,8 @@ func (mw *MessageWriter) StartURI(uri, resumePoint string, size int64, usedMirro
 // FinishURI writes a '201 URI Done' message.
 func (mw *MessageWriter) FinishURI(uri, filename, resumePoint, altIMSHit string,
 	imsHit, usedMirror bool, extra ...Field) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 
 	fmt.Fprintf(mw.w, "201 URI Done\nURI: %s\nFilename: %s\n", uri, filename)
 	if resumePoint != "" {
@@ -362,7 +439,7 @@ func (mw *MessageWriter) FinishURI(uri, filename, resumePoint, altIMSHit string,
 
 	// TODO: Make this better...
 	for _, s := range extra {
-		fmt.Fprintf(mw.w, "%s: %s\n", s.Key, s.Value)
+		fmt.Fprintf(mw.w, "%s: %s\n", s.Key, oneLine(s.Value))
 	}
 
 	mw.w.Write([]byte("\n"))
@@ -370,6 +447,8 @@ func (mw *MessageWriter) FinishURI(uri, filename, resumePoint, altIMSHit string,
 
 // AuxRequest writes a '351 Aux Request' message.
 func (mw *MessageWriter) AuxRequest(uri, auxURI, descShort, descLong string, maximumSize uint64, usedMirror bool) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "351 Aux Request\nURI: %s\n", uri)
 	if auxURI != "" {
 		fmt.Fprintf(mw.w, "Aux-URI: %s\n", auxURI)
@@ -391,31 +470,45 @@ func (mw *MessageWriter) AuxRequest(uri, auxURI, descShort, descLong string, max
 
 // FailedURI writes a '400 URI Failure' message.
 //
-// The message parameter should be "" unless the intent is to send a malformed
-// URI Failure message
-// failReason is only used if transientError is false
-func (mw *MessageWriter) FailedURI(uri, message, failReason string, transientError, usedMirror bool) {
+// The message is shown to the user by apt and may be "" if there is nothing
+// to add to the failReason. It may span several lines, which are joined. If uri is "", only the message is written.
+// failReason is "" if there is no more specific reason for the failure. If
+// transientError is true, apt may retry the request. Any extra fields are
+// written at the end of the message.
+func (mw *MessageWriter) FailedURI(uri, message, failReason string, transientError, usedMirror bool,
+	extra ...Field) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	mw.w.Write([]byte("400 URI Failure\n"))
 	if uri == "" {
-		fmt.Fprintf(mw.w, "Message: %s\n\n", message)
+		fmt.Fprintf(mw.w, "Message: %s\n\n", oneLine(message))
 		return
 	}
 	fmt.Fprintf(mw.w, "URI: %s\n", uri)
+	if message != "" {
+		fmt.Fprintf(mw.w, "Message: %s\n", oneLine(message))
+	}
 
+	if failReason != "" {
+		fmt.Fprintf(mw.w, "FailReason: %s\n", failReason)
+	}
 	if transientError {
 		mw.w.Write([]byte("Transient-Failure: true\n"))
-	} else {
-		fmt.Fprintf(mw.w, "FailReason: %s\n", failReason)
 	}
 	if usedMirror {
 		mw.w.Write([]byte("UsedMirror: true\n"))
 	}
+	for _, s := range extra {
+		fmt.Fprintf(mw.w, "%s: %s\n", s.Key, oneLine(s.Value))
+	}
 	mw.w.Write([]byte("\n"))
 }
 
 // GeneralFailure writes a '401 General Failure' message.
 func (mw *MessageWriter) GeneralFailure(msg string) {
-	fmt.Fprintf(mw.w, "401 General Failure\nMessage: %s\n\n", msg)
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	fmt.Fprintf(mw.w, "401 General Failure\nMessage: %s\n\n", oneLine(msg))
 }
 
 // GeneralFailuref writes a '401 General Failure' message and formats the
@@ -426,5 +519,7 @@ func (mw *MessageWriter) GeneralFailuref(fmtspec string, args ...interface{}) {
 
 // MediaChange writes a '403 Media Change' message.
 func (mw *MessageWriter) MediaChange(media, drive string) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
 	fmt.Fprintf(mw.w, "403 Media Change\nMedia: %s\nDrive: %s\n\n", media, drive)
 }
@@ -12,7 +12,9 @@ import (
 
 func TestMessage(t *testing.T) {
 	t.Run("NewMessage", testNewMessage)
+	t.Run("Fields", testMessageFields)
 	t.Run("ReadMessage", testReadMessage)
+	t.Run("RoundTrip", testMessageRoundTrip)
 }
 
 func testNewMessage(t *testing.T) {
@@ -36,6 +38,49 @@ func testNewMessage(t *testing.T) {
 	})
 }
 
+func testMessageFields(t *testing.T) {
+	msg := NewMessage(601, "Configuration",
+		Field{"Config-Item", "Acquire::cfd+https::Timeout=10"},
+		Field{"Config-Item", "Acquire::cfd+https::Retries=2"})
+	msg.Add("URI", "cfd+https://repo.example.com/")
+	msg.Add("config-item", "Acquire::cfd+https::Workers=8")
+
+	assert.Equal(t, "Acquire::cfd+https::Timeout=10", msg.Get("Config-Item"))
+	assert.Equal(t, "cfd+https://repo.example.com/", msg.Get("uri"))
+	assert.Equal(t, "", msg.Get("Filename"))
+	assert.Equal(t, []string{
+		"Acquire::cfd+https::Timeout=10",
+		"Acquire::cfd+https::Retries=2",
+		"Acquire::cfd+https::Workers=8",
+	}, msg.GetAll("Config-Item"))
+	assert.Nil(t, msg.GetAll("Filename"))
+
+	assert.Equal(t, []Field{
+		{"Config-Item", "Acquire::cfd+https::Timeout=10"},
+		{"Config-Item", "Acquire::cfd+https::Retries=2"},
+		{"URI", "cfd+https://repo.example.com/"},
+		{"config-item", "Acquire::cfd+https::Workers=8"},
+	}, msg.Fields)
+}
+
+func testMessageRoundTrip(t *testing.T) {
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::cfd+https::Timeout=10\n" +
+		"Config-Item: Acquire::cfd+https::Retries=2\n" +
+		"Config-Item: Acquire::cfd+https::Workers=8\n" +
+		"Empty: \n" +
+		"Config-Item: APT::Architecture=amd64\n\n"
+
+	mreader := NewMessageReader(bufio.NewReader(strings.NewReader(input)))
+	msg, err := mreader.ReadMessage()
+	require.NoError(t, err)
+	assert.Len(t, msg.GetAll("Config-Item"), 4)
+
+	var out strings.Builder
+	NewMessageWriter(&out).WriteMessage(msg)
+	assert.Equal(t, input, out.String())
+}
+
 func testReadMessage(t *testing.T) {
 	t.Run("NoDesc", testReadMessageNoDesc)
 	t.Run("EOF", testReadMessageEOF)
@@ -140,6 +185,28 @@ func TestWriteMessage(t *testing.T) {
 	if out.String() != expected {
 		t.Errorf("Writer failed to write message correctly")
 	}
+
+	out.Reset()
+	mwriter.WriteMessage(NewMessage(600, "Acquire URI",
+		Field{"URI", "cfd+https://repo.example.com/a"}, Field{"", "skipped"},
+		Field{"Filename", "/tmp/a"}, Field{"URI", "cfd+https://repo.example.com/b"}))
+	expected = "600 Acquire URI\nURI: cfd+https://repo.example.com/a\nFilename: /tmp/a\n" +
+		"URI: cfd+https://repo.example.com/b\n\n"
+	assert.Equal(t, expected, out.String())
+}
+
+func TestWriteMessageOneLine(t *testing.T) {
+	var out strings.Builder
+	mwriter := NewMessageWriter(&out)
+	mwriter.FailedURI("cfd+https://repo.example.com/a", "exit status 1: line1\n\nline3\r\n", "AuthFailure",
+		false, false)
+	mwriter.Warning("first\tsecond\x1b[31m")
+	mwriter.WriteMessage(NewMessage(101, "Log", Field{"Message", "a\nb"}))
+
+	assert.Equal(t, "400 URI Failure\nURI: cfd+https://repo.example.com/a\n"+
+		"Message: exit status 1: line1 line3 \nFailReason: AuthFailure\n\n"+
+		"104 Warning\nMessage: first second [31m\n\n"+
+		"101 Log\nMessage: a b\n\n", out.String())
 }
 
 func TestCapabilities(t *testing.T) {
@@ -248,14 +315,35 @@ func TestFailedURI(t *testing.T) {
 		var out strings.Builder
 		mwriter := NewMessageWriter(&out)
 		mwriter.FailedURI("url", "message", "reason", true, true)
-		expected := "400 URI Failure\nURI: url\nTransient-Failure: true\n" +
-			"UsedMirror: true\n\n"
+		expected := "400 URI Failure\nURI: url\nMessage: message\nFailReason: reason\n" +
+			"Transient-Failure: true\nUsedMirror: true\n\n"
+		assert.Equal(t, expected, out.String())
+	})
+	t.Run("No Reason", func(t *testing.T) {
+		var out strings.Builder
+		mwriter := NewMessageWriter(&out)
+		mwriter.FailedURI("url", "message", "", true, false)
+		expected := "400 URI Failure\nURI: url\nMessage: message\nTransient-Failure: true\n\n"
 		assert.Equal(t, expected, out.String())
 	})
 	t.Run("Regular Error", func(t *testing.T) {
 		var out strings.Builder
 		mwriter := NewMessageWriter(&out)
 		mwriter.FailedURI("url", "message", "reason", false, false)
+		expected := "400 URI Failure\nURI: url\nMessage: message\nFailReason: reason\n\n"
+		assert.Equal(t, expected, out.String())
+	})
+	t.Run("Extra Fields", func(t *testing.T) {
+		var out strings.Builder
+		mwriter := NewMessageWriter(&out)
+		mwriter.FailedURI("url", "message", "reason", false, false, Field{"SHA256-Hash", "abc"})
+		expected := "400 URI Failure\nURI: url\nMessage: message\nFailReason: reason\nSHA256-Hash: abc\n\n"
+		assert.Equal(t, expected, out.String())
+	})
+	t.Run("No Message", func(t *testing.T) {
+		var out strings.Builder
+		mwriter := NewMessageWriter(&out)
+		mwriter.FailedURI("url", "", "reason", false, false)
 		expected := "400 URI Failure\nURI: url\nFailReason: reason\n\n"
 		assert.Equal(t, expected, out.String())
 	})
@@ -3,10 +3,7 @@ package apt
 import (
 	"bufio"
 	"context"
-	"crypto/md5"  // #nosec
-	"crypto/sha1" // #nosec
-	"crypto/sha256"
-	"crypto/sha512"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,14 +11,21 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/apt-transport-cloudflared/apt/access"
+	"github.com/cloudflare/apt-transport-cloudflared/apt/qr"
 )
 
 const (
 	cfdVersion string = "0.1"
+
+	// defaultWorkers is the number of acquires handled at once if apt does
+	// not configure Acquire::cfd+https::Workers.
+	defaultWorkers int = 4
 )
 
 // CloudflaredMethod holds the fields needed to run the apt method.
@@ -29,9 +33,26 @@ type CloudflaredMethod struct {
 	mwriter   *MessageWriter
 	mreader   *MessageReader
 	urlwriter *URLWriter
-	datapath  string
+	config    *Config
 	client    *http.Client
 	transport http.RoundTripper
+	tokens    *access.TokenCache
+	etags     *etagStore
+	keys      *access.KeyCache
+
+	// proxies holds the transports used for hosts with a proxy configured,
+	// keyed by proxy.
+	proxies   map[string]http.RoundTripper
+	proxiesMu sync.Mutex
+
+	// identities holds the identity last shown for each host, so that it is
+	// only shown again if it changes.
+	identities   map[string]string
+	identitiesMu sync.Mutex
+
+	// acquires feeds '600 URI Acquire' messages to the worker pool.
+	acquires chan *Message
+	wg       sync.WaitGroup
 }
 
 // HeaderEntry represents a header to be added to a request.
@@ -60,22 +81,103 @@ func NewCloudflaredMethod(client *http.Client, output io.Writer, input *bufio.Re
 		client = http.DefaultClient
 	}
 
-	return &CloudflaredMethod{
-		mwriter:   NewMessageWriter(output),
-		mreader:   NewMessageReader(input),
-		datapath:  path.Join(home, ".cloudflared/cfd/servicetokens/"),
-		urlwriter: NewURLWriter(os.Stderr, "Auth URL: "),
-		client:    client,
-		transport: client.Transport,
-	}, nil
+	config := NewConfig()
+	config.ServiceTokenDir = path.Join(home, ".cloudflared/cfd/servicetokens/")
+	config.TokenDir = path.Join(home, ".cloudflared")
+
+	cfd := &CloudflaredMethod{
+		mwriter:    NewMessageWriter(output),
+		mreader:    NewMessageReader(input),
+		config:     config,
+		client:     client,
+		transport:  client.Transport,
+		tokens:     access.NewTokenCache(),
+		etags:      loadETagStore(""),
+		keys:       access.NewKeyCache(""),
+		proxies:    make(map[string]http.RoundTripper),
+		identities: make(map[string]string),
+	}
+	cfd.urlwriter = NewURLWriterFunc(cfd.showAuthURL)
+	return cfd, nil
+}
+
+// showAuthURL shows the user the URL to open to log in to Access, as
+// configured by Acquire::cfd+https::Auth-URL-Output.
+//
+// Apt frontends show warning messages in full, and status messages cut down
+// to the width of the progress line, while the method's stderr is often lost
+// or mixed up with apt's progress output.
+func (cfd *CloudflaredMethod) showAuthURL(url string) {
+	switch cfd.config.AuthURLOutput {
+	case authURLStatus:
+		cfd.mwriter.Statusf("Auth URL: %s", url)
+	case authURLStderr:
+		fmt.Fprintf(os.Stderr, "\rAuth URL: %s\n", url)
+	default:
+		cfd.mwriter.Warningf("Auth URL: %s", url)
+	}
+
+	if cfd.config.AuthURLQR != authURLQRNone {
+		cfd.showQR(url)
+	}
+}
+
+// showIdentity tells the user who the method authenticates to the host as,
+// and which provider the token came from, so that it is clear which
+// credentials a download used. It is shown once for each host, and again if
+// the identity changes, e.g. after logging in again.
+func (cfd *CloudflaredMethod) showIdentity(host, provider string, token access.Token) {
+	msg := fmt.Sprintf("Access identity for %s: %s (from %s)", host, access.Identity(token), provider)
+
+	cfd.identitiesMu.Lock()
+	defer cfd.identitiesMu.Unlock()
+	if cfd.identities[host] == msg {
+		return
+	}
+	cfd.identities[host] = msg
+	cfd.mwriter.Status(msg)
+}
+
+// openTTY opens the controlling terminal for writing. It is a variable so that
+// tests can replace it.
+var openTTY = func() (io.WriteCloser, error) {
+	return os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+}
+
+// showQR draws the URL as a QR code on the controlling terminal, so that users
+// who can't open it from the terminal, e.g. over SSH, can open it on a phone.
+//
+// Apt messages can't carry the code, as apt cuts each one down to a single
+// line, so if the terminal can't be opened, e.g. because apt isn't run from
+// one, the user is warned that there is no code instead.
+func (cfd *CloudflaredMethod) showQR(url string) {
+	code, err := qr.Encode(url, qr.Low)
+	if err != nil {
+		cfd.mwriter.Warningf("Unable to draw the auth URL as a QR code: %v", err)
+		return
+	}
+
+	tty, err := openTTY()
+	if err != nil {
+		cfd.mwriter.Warningf("Unable to draw the auth URL as a QR code, as the terminal can't be opened: %v", err)
+		return
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "\r\n%s", code)
 }
 
 // Run is the main entry point for the method.
 //
 // This function reads messages from apt indefinitely and attempts to handle
-// as many of them as possible.
+// as many of them as possible. Acquire requests are handed off to a pool of
+// workers, so apt may pipeline several of them at once.
 func (cfd *CloudflaredMethod) Run() bool {
-	cfd.mwriter.Capabilities(cfdVersion, CapSendConfig|CapSingleInstance)
+	cfd.mwriter.Capabilities(cfdVersion, CapSendConfig|CapSingleInstance|CapPipeline)
+
+	// Make sure every queued acquire has finished before we return, otherwise
+	// apt would be left waiting on URIs which never complete.
+	defer cfd.stopWorkers()
+
 	for {
 		msg, err := cfd.mreader.ReadMessage()
 		if err != nil {
@@ -91,7 +193,7 @@ func (cfd *CloudflaredMethod) Run() bool {
 
 		switch msg.StatusCode {
 		case 600: // Acquire URL
-			cfd.HandleAcquire(msg)
+			cfd.queueAcquire(msg)
 		case 601: // Configuration
 			err := cfd.ParseConfig(msg)
 			if err != nil {
@@ -106,131 +208,672 @@ func (cfd *CloudflaredMethod) Run() bool {
 	}
 }
 
+// queueAcquire hands an acquire message to the worker pool, starting the pool
+// if needed.
+//
+// The pool is started lazily so that the configuration message apt sends
+// before the first acquire can set the number of workers.
+func (cfd *CloudflaredMethod) queueAcquire(msg *Message) {
+	if cfd.acquires == nil {
+		cfd.startWorkers()
+	}
+	cfd.acquires <- msg
+}
+
+// startWorkers starts the goroutines which handle acquire messages.
+func (cfd *CloudflaredMethod) startWorkers() {
+	cfd.etags = loadETagStore(cfd.config.ETagCache)
+	cfd.keys = access.NewKeyCache(cfd.config.CertsCacheDir)
+	cfd.acquires = make(chan *Message)
+	for i := 0; i < cfd.config.Workers; i++ {
+		cfd.wg.Add(1)
+		go func() {
+			defer cfd.wg.Done()
+			for msg := range cfd.acquires {
+				cfd.HandleAcquire(msg)
+			}
+		}()
+	}
+}
+
+// stopWorkers waits for all queued acquire messages to be handled and then
+// stops the worker pool.
+func (cfd *CloudflaredMethod) stopWorkers() {
+	if cfd.acquires == nil {
+		return
+	}
+	close(cfd.acquires)
+	cfd.wg.Wait()
+	cfd.acquires = nil
+}
+
 // BuildRequest creates a new http.Request for the given URI.
+//
+// The token for the URI is applied to the client's transport, so the client
+// must not be shared with other requests.
 func (cfd *CloudflaredMethod) BuildRequest(client *http.Client, uri *url.URL) (*http.Request, error) {
+	req, _, err := cfd.buildRequest(client, uri)
+	return req, err
+}
+
+// buildRequest is BuildRequest, but also returns the token applied to the
+// client's transport.
+func (cfd *CloudflaredMethod) buildRequest(client *http.Client, uri *url.URL) (*http.Request, access.Token, error) {
 	if uri.Scheme != "cfd+https" {
 		cfd.mwriter.Log(fmt.Sprintf("Invalid URI Scheme: %q", uri.Scheme))
-		return nil, fmt.Errorf("invalid URI Scheme: '%s'", uri.Scheme)
+		return nil, nil, fmt.Errorf("invalid URI Scheme: '%s'", uri.Scheme)
 	}
 
 	uri.Scheme = "https"
+	cfg := cfd.config.ForHost(uri.Host)
 
-	// TODO: Allow configuring this
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
 	defer cancel()
 
 	cfd.mwriter.Log(fmt.Sprintf("Getting JWT for %v", uri))
-	token, err := access.GetToken(ctx, uri, cfd.datapath, true, cfd.urlwriter)
+	plain := &http.Client{Transport: client.Transport}
+	token, provider, err := cfd.tokens.GetTokenFrom(ctx, uri, &access.Options{
+		SystemTokenDir:          cfg.SystemTokenDir,
+		ServiceTokenDir:         cfg.ServiceTokenDir,
+		AllowInsecureTokens:     cfg.AllowInsecureTokens,
+		Cloudflared:             cfg.Cloudflared,
+		Output:                  cfd.urlwriter,
+		NativeLogin:             cfg.NativeLogin,
+		TransferURL:             cfg.TransferURL,
+		Client:                  plain,
+		TokenDir:                cfg.TokenDir,
+		Providers:               cfg.Providers,
+		CredentialHelper:        cfg.CredentialHelper,
+		CredentialHelperArgs:    cfg.CredentialHelperArgs,
+		CredentialHelperTimeout: cfg.CredentialHelperTimeout,
+		Warn:                    cfd.mwriter.Warning,
+		NonInteractive:          !cfg.Interactive.Enabled(),
+		Validation: access.ValidationOptions{
+			TeamDomain:      cfg.TeamDomain,
+			Audience:        cfg.Audience,
+			VerifySignature: cfg.VerifySignature,
+			Keys:            cfd.keys,
+			Client:          plain,
+		},
+	})
 	if err != nil {
-		return nil, err
+		authErr := &AuthError{URI: uri.String(), Reason: fmt.Sprintf("unable to get an Access token: %v", err)}
+
+		var insecure *access.InsecureFileError
+		if errors.As(err, &insecure) {
+			authErr.Reason += fmt.Sprintf("; make it readable only by its owner (chmod 600), "+
+				"or set %sAllow-Insecure-Tokens to use it anyway", configPrefix)
+		}
+
+		var timeout *access.HelperTimeoutError
+		if errors.As(err, &timeout) {
+			authErr.Reason += fmt.Sprintf("; set %sCredential-Helper-Timeout to give it more than %d seconds",
+				configPrefix, int(timeout.Timeout/time.Second))
+		}
+
+		var loginRequired *access.LoginRequiredError
+		if errors.As(err, &loginRequired) {
+			authErr.Reason += "; use a service token for unattended runs, " +
+				"or run apt interactively or with " + configPrefix + "Interactive=true to log in"
+			authErr.AppURL = loginRequired.AppURL
+		}
+		return nil, nil, authErr
+	}
+	cfd.mwriter.Logf("Using token for %s from %s", uri.Host, provider)
+	if cfg.ShowIdentity {
+		cfd.showIdentity(uri.Host, provider, token)
 	}
 
-	cfd.client.Transport = access.NewTransport(token, cfd.transport)
+	client.Transport = access.NewTransport(token, client.Transport)
 
 	req, err := http.NewRequest("GET", uri.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
 	}
 
-	return req, nil
+	return req, token, nil
+}
+
+// AcquireRequest holds the fields of a '600 URI Acquire' message used by the
+// method.
+type AcquireRequest struct {
+	// URI is the URI as apt sent it.
+	URI string
+
+	// Filename is the file the resource is written to.
+	Filename string
+
+	// LastModified is the modification time of the copy of the resource apt
+	// already has, or the zero time if it doesn't have one.
+	LastModified time.Time
+
+	// ExpectedHashes are the 'Expected-*' hash fields the downloaded file
+	// must match.
+	ExpectedHashes []Field
+
+	// MaximumSize is the largest the downloaded file may be, or 0 if there
+	// is no limit.
+	MaximumSize int64
+}
+
+// NewAcquireRequest reads the fields of a '600 URI Acquire' message.
+func NewAcquireRequest(msg *Message) *AcquireRequest {
+	req := &AcquireRequest{
+		URI:      msg.Get("URI"),
+		Filename: msg.Get("Filename"),
+	}
+
+	if lastModified := msg.Get("Last-Modified"); lastModified != "" {
+		// If the time can't be parsed, the resource is just downloaded again
+		req.LastModified, _ = http.ParseTime(lastModified)
+	}
+
+	for _, field := range msg.Fields {
+		if _, ok := expectedHashFields[strings.ToLower(field.Key)]; ok {
+			req.ExpectedHashes = append(req.ExpectedHashes, field)
+		}
+	}
+
+	if maximumSize := msg.Get("Maximum-Size"); maximumSize != "" {
+		// If the size can't be parsed, there is no limit
+		req.MaximumSize, _ = strconv.ParseInt(maximumSize, 10, 64)
+	}
+	return req
 }
 
 // HandleAcquire handles a '600 Acquire URI' message from apt.
 //
 // This attempts to get a token for the given host and make a request for the
 // resource with the cf-access-token headers.
-//
-// TODO: Figure out what an IMS-Hit indicates, and if that applies to this method
 func (cfd *CloudflaredMethod) HandleAcquire(msg *Message) {
-	requestedURL := msg.Fields["URI"]
-	filename := msg.Fields["Filename"]
+	req := NewAcquireRequest(msg)
 
 	// TODO: Handle empty URI or Filename
 	// This shouldn't happen, but it's best to be absurdly fault tolerant if possible
 
-	uri, err := url.Parse(requestedURL)
+	uri, err := url.Parse(req.URI)
 	if err != nil {
 		// Have to have started the Acquire before we can fail the acquire
-		cfd.mwriter.StartURI(requestedURL, "", 0, false)
-		cfd.mwriter.FailedURI(requestedURL, "", fmt.Sprintf("URI Parse Failure: %v", err), false, false)
+		cfd.mwriter.StartURI(req.URI, "", 0, false)
+		cfd.mwriter.FailedURI(req.URI, "", fmt.Sprintf("URI Parse Failure: %v", err), false, false)
 		return
 	}
 
-	err = cfd.Acquire(uri, requestedURL, filename)
+	err = cfd.Acquire(uri, req)
 	if err != nil {
-		cfd.mwriter.FailedURI(requestedURL, err.Error(), err.Error(), false, false)
+		failure := classifyError(err)
+		cfd.mwriter.FailedURI(req.URI, err.Error(), failure.Reason, failure.Transient, false, failure.Fields...)
 	}
 }
 
+// get builds a request for the URI with the given extra headers and sends it,
+// and returns the token it was sent with.
+func (cfd *CloudflaredMethod) get(uri *url.URL, header http.Header) (*http.Response, access.Token, error) {
+	cfg := cfd.config.ForHost(uri.Host)
+
+	// Each request gets its own copy of the client, as the transport holds
+	// the token for the requested host, and its own copy of the URI, as
+	// BuildRequest rewrites the scheme.
+	client := *cfd.client
+	client.Transport = cfd.transportFor(cfg)
+	requri := *uri
+
+	req, token, err := cfd.buildRequest(&client, &requri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	return resp, token, err
+}
+
+// transportFor returns the transport to send requests with, given the
+// settings for the host.
+func (cfd *CloudflaredMethod) transportFor(cfg *Config) http.RoundTripper {
+	if cfg.Proxy == "" {
+		return cfd.transport
+	}
+
+	cfd.proxiesMu.Lock()
+	defer cfd.proxiesMu.Unlock()
+
+	if rt, ok := cfd.proxies[cfg.Proxy]; ok {
+		return rt
+	}
+
+	parent := cfd.transport
+	if parent == nil {
+		parent = http.DefaultTransport
+	}
+
+	base, ok := parent.(*http.Transport)
+	if !ok {
+		cfd.mwriter.Logf("Can not set the proxy of a %T, ignoring proxy %s", parent, cfg.Proxy)
+		return cfd.transport
+	}
+
+	transport := base.Clone()
+	transport.Proxy = nil
+	if cfg.Proxy != proxyDirect {
+		// The proxy was checked when the configuration was parsed
+		proxy, _ := url.Parse(cfg.Proxy)
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	cfd.proxies[cfg.Proxy] = transport
+	return transport
+}
+
 // Acquire fetches the requested resource.
-func (cfd *CloudflaredMethod) Acquire(uri *url.URL, requrl, filename string) error {
+//
+// If apt already has a copy of the resource, the request is made conditional
+// on the resource having changed, and apt is told to keep its copy (an IMS
+// hit) if it hasn't. If apt left a partial download behind, the download is
+// resumed from the end of it.
+//
+// If the connection fails while the body is downloaded, the download is
+// resumed from the part already written, sharing the retries configured for
+// the host with the requests.
+//
+// Acquire may be called from several goroutines at once.
+func (cfd *CloudflaredMethod) Acquire(uri *url.URL, acq *AcquireRequest) error {
+	state := &acquireState{}
+	for {
+		err := cfd.acquire(uri, acq, state)
+
+		var readErr *readError
+		if !errors.As(err, &readErr) || !cfd.backoff(uri, &state.attempt, classifyError(err)) {
+			return err
+		}
+	}
+}
+
+// acquireState is what is kept between the attempts of an acquire.
+type acquireState struct {
+	// attempt is the number of retries made so far.
+	attempt int
 
-	// Build our request
-	req, err := cfd.BuildRequest(cfd.client, uri)
+	// started is true once apt has been told the download started, which it
+	// is only told once, along with resumePoint.
+	started     bool
+	resumePoint string
+}
+
+// start tells apt that the download of the resource started at offset, unless
+// it has already been told.
+func (cfd *CloudflaredMethod) start(acq *AcquireRequest, state *acquireState, offset, size int64) {
+	if state.started {
+		return
+	}
+	if offset > 0 {
+		state.resumePoint = strconv.FormatInt(offset, 10)
+	}
+	state.started = true
+	cfd.mwriter.StartURI(acq.URI, state.resumePoint, size, false)
+}
+
+// acquire makes a single attempt at fetching the resource, resuming the
+// partial file there is from an earlier attempt, or that apt left behind.
+func (cfd *CloudflaredMethod) acquire(uri *url.URL, acq *AcquireRequest, state *acquireState) error {
+	requrl, filename := acq.URI, acq.Filename
+	partial := statPartial(filename)
+
+	resp, err := cfd.fetchWithRetries(uri, acq, partial, &state.attempt)
+	if err == nil && partial != nil {
+		if _, ok := resumeOffset(resp, partial.Size()); !ok {
+			resp.Body.Close()
+			cfd.mwriter.Logf("Unable to resume %s from byte %d (%s), downloading it again",
+				requrl, partial.Size(), resp.Status)
+			partial = nil
+			resp, err = cfd.fetchWithRetries(uri, acq, nil, &state.attempt)
+		}
+	}
 	if err != nil {
-		cfd.mwriter.StartURI(requrl, "", 0, false)
+		cfd.start(acq, state, 0, 0)
+		return err
+	}
+
+	// Close the body at the end of the method
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && partial == nil && !acq.LastModified.IsZero() {
+		cfd.start(acq, state, 0, 0)
+		cfd.mwriter.FinishURI(requrl, filename, "", "", true, false)
+		return nil
+	}
+
+	var offset int64
+	if partial != nil {
+		offset, _ = resumeOffset(resp, partial.Size())
+	}
+
+	body := io.Reader(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is already complete
+		body = strings.NewReader("")
+	default:
+		cfd.start(acq, state, 0, 0)
+		return classifyResponse(uri.String(), resp)
+	}
+
+	size := offset
+	if body == resp.Body && resp.ContentLength > 0 {
+		size += resp.ContentLength
+	}
+	cfd.start(acq, state, offset, size)
+	if acq.MaximumSize > 0 && size > acq.MaximumSize {
+		// The partial file is of no use, as the whole file is too large
+		cfd.removeDownload(acq)
+		return maximumSizeExceeded(acq.MaximumSize)
+	}
+
+	sums, err := cfd.downloadVerified(body, acq, offset)
+	if _, ok := err.(*URIFailure); ok {
 		return err
 	}
 
-	resp, err := cfd.client.Do(req)
+	// Save the validators even if the download failed, so that the partial
+	// file can be resumed
+	validators := cfd.saveValidators(resp, acq)
 	if err != nil {
-		cfd.mwriter.StartURI(requrl, "", 0, false)
 		return err
 	}
 
-	// Handle non-200 responses
-	// TODO: Handle other 200 codes
-	if resp.StatusCode != 200 {
-		cfd.mwriter.StartURI(requrl, "", 0, false)
-		return fmt.Errorf("GET for %s failed with %s", uri.String(), resp.Status)
+	fields := append(sums.Fields(), validators...)
+	cfd.mwriter.FinishURI(requrl, filename, state.resumePoint, "", false, false, fields...)
+
+	return nil
+}
+
+// fetch requests the resource, resuming the given partial file if it isn't
+// nil.
+//
+// If Access rejects the token used for the request, the token is dropped from
+// the cache and the request is retried once with a new one. This includes
+// responses which are the Access login page, so the login page is never
+// written out as the requested file. If another request has already replaced
+// the rejected token, the retry uses that token rather than fetching another.
+func (cfd *CloudflaredMethod) fetch(uri *url.URL, acq *AcquireRequest, partial os.FileInfo) (*http.Response, error) {
+	header := cfd.requestHeader(acq, partial)
+
+	resp, token, err := cfd.get(uri, header)
+	if err != nil || !access.IsRejected(resp) {
+		return resp, err
 	}
 
-	cfd.mwriter.StartURI(requrl, "", resp.ContentLength, false)
+	resp.Body.Close()
+	cfd.mwriter.Logf("Access rejected the token for %s (%s), getting a new one", uri.Host, access.Rejection(resp))
+	cfd.tokens.Invalidate(access.CacheKey(uri), token)
+
+	resp, _, err = cfd.get(uri, header)
+	if err != nil || !access.IsRejected(resp) {
+		return resp, err
+	}
+
+	resp.Body.Close()
+	return nil, &AuthError{
+		URI:     uri.String(),
+		Reason:  fmt.Sprintf("Access rejected the request (%s)", access.Rejection(resp)),
+		AuthURL: access.AuthURL(resp),
+	}
+}
+
+// fetchWithRetries fetches the resource, retrying requests which fail with a
+// transient error as configured for the host. attempt counts the retries made
+// for the acquire so far.
+func (cfd *CloudflaredMethod) fetchWithRetries(uri *url.URL, acq *AcquireRequest,
+	partial os.FileInfo, attempt *int) (*http.Response, error) {
+	for {
+		resp, err := cfd.fetch(uri, acq, partial)
+
+		var failure *URIFailure
+		if err != nil {
+			failure = classifyError(err)
+		} else if isFailureStatus(resp.StatusCode) {
+			failure = classifyResponse(uri.String(), resp)
+		}
+		if failure == nil || !cfd.backoff(uri, attempt, failure) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// backoff waits before retrying a request for the resource which failed, and
+// reports whether it should be retried at all, given the retries configured
+// for the host and the number of retries made so far, attempt.
+//
+// Retries back off exponentially, and wait for at least as long as the server
+// asks for with Retry-After.
+func (cfd *CloudflaredMethod) backoff(uri *url.URL, attempt *int, failure *URIFailure) bool {
+	cfg := cfd.config.ForHost(uri.Host)
+	if !failure.Transient || *attempt >= cfg.Retries {
+		return false
+	}
+
+	delay, ok := retryDelay(cfg.RetryDelay, *attempt, failure.RetryAfter)
+	if !ok {
+		return false
+	}
+
+	*attempt++
+	cfd.mwriter.Logf("Request for %s failed (%v), retrying in %v (%d/%d)",
+		uri.String(), failure, delay.Round(time.Millisecond), *attempt, cfg.Retries)
+	time.Sleep(delay)
+	return true
+}
+
+// requestHeader returns the extra headers to send when requesting the
+// resource.
+//
+// If there is a partial file, the request asks for the rest of the resource,
+// provided it hasn't changed since the partial file was downloaded.
+// Otherwise, if apt already has a copy of the resource, the request is made
+// conditional on the resource having changed since apt last downloaded it.
+func (cfd *CloudflaredMethod) requestHeader(acq *AcquireRequest, partial os.FileInfo) http.Header {
+	header := make(http.Header)
+
+	if partial != nil {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", partial.Size()))
+
+		// Weak ETags can't be used in an If-Range. The modification time of
+		// the partial file is set to the Last-Modified time of the resource,
+		// so it can be used instead.
+		etag := cfd.etags.Get(acq.URI, partial.ModTime())
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("If-Range", etag)
+		} else {
+			header.Set("If-Range", partial.ModTime().UTC().Format(http.TimeFormat))
+		}
+		return header
+	}
+
+	// There is nothing for apt to fall back on if it doesn't have a copy
+	if acq.LastModified.IsZero() {
+		return header
+	}
+
+	header.Set("If-Modified-Since", acq.LastModified.UTC().Format(http.TimeFormat))
+	if etag := cfd.etags.Get(acq.URI, acq.LastModified); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	return header
+}
+
+// statPartial returns the details of a partial download apt left behind, or
+// nil if there isn't one.
+func statPartial(filename string) os.FileInfo {
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	return info
+}
+
+// resumeOffset works out where the body of the response starts in the file,
+// given the size of the partial file.
+//
+// ok is false if the response can't be used, because the server returned a
+// different range than was asked for, or the partial file doesn't match the
+// resource.
+func resumeOffset(resp *http.Response, size int64) (offset int64, ok bool) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end, total int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if err != nil || start != size {
+			return 0, false
+		}
+		return size, true
+	case http.StatusRequestedRangeNotSatisfiable:
+		var total int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total)
+		if err != nil || total != size {
+			return 0, false
+		}
+		return size, true
+	}
+
+	// Anything else is either the whole resource or an error
+	return 0, true
+}
+
+// download writes the body to the file, starting at offset and keeping the
+// first offset bytes of the file, and returns the hashes of the whole file.
+//
+// If maxSize isn't 0, the download is stopped as soon as the file is larger
+// than maxSize, and a *URIFailure is returned.
+func download(body io.Reader, filename string, offset, maxSize int64) (*hashes, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	fp, err := os.OpenFile(filename, flags, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file '%s': %v", filename, err)
+	}
+	defer fp.Close()
+
+	// We want to compute our different hashes, otherwise Apt will reject the
+	// package. The hashes cover the part of the file we already have.
+	sums := newHashes()
+	if offset > 0 {
+		if _, err := io.CopyN(sums, fp, offset); err != nil {
+			return nil, fmt.Errorf("error reading partial file '%s': %v", filename, err)
+		}
+		if err := fp.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("error truncating partial file '%s': %v", filename, err)
+		}
+	}
 
-	// Close the body at the end of the method
-	defer resp.Body.Close()
 	// We buffer up to 16kb at a time
 	buffer := make([]byte, 1024*16)
 
-	// We want to compute our different hashes, otherwise Apt will reject the package
-	hashMD5 := md5.New()   // #nosec
-	hashSHA1 := sha1.New() // #nosec
-	hashSHA256 := sha256.New()
-	hashSHA512 := sha512.New()
+	// Read at most one byte more than the maximum, which is enough to tell
+	// that the file is too large
+	if maxSize > 0 {
+		body = io.LimitReader(body, maxSize-offset+1)
+	}
 
-	// And finally, we need to write to this file
-	fp, err := os.Create(filename)
+	mw := io.MultiWriter(sums, fp)
+	n, err := io.CopyBuffer(mw, body, buffer)
 	if err != nil {
-		return fmt.Errorf("error opening file '%s': %v", filename, err)
+		return nil, &readError{Err: err}
+	}
+	if maxSize > 0 && offset+n > maxSize {
+		return nil, maximumSizeExceeded(maxSize)
 	}
 
-	mw := io.MultiWriter(hashMD5, hashSHA1, hashSHA256, hashSHA512, fp)
-	if _, err := io.CopyBuffer(mw, resp.Body, buffer); err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+	if err := fp.Close(); err != nil {
+		return nil, fmt.Errorf("error writing file '%s': %v", filename, err)
 	}
+	return sums, nil
+}
 
-	strMD5 := fmt.Sprintf("%x", hashMD5.Sum(nil))
-	strSHA1 := fmt.Sprintf("%x", hashSHA1.Sum(nil))
-	strSHA256 := fmt.Sprintf("%x", hashSHA256.Sum(nil))
-	strSHA512 := fmt.Sprintf("%x", hashSHA512.Sum(nil))
+// downloadVerified downloads the body to the requested file, starting at
+// offset, and checks that it is the file apt asked for.
+//
+// If the file is larger than the maximum size or doesn't match the expected
+// hashes, it is removed, as it can't be resumed, and a *URIFailure is
+// returned.
+func (cfd *CloudflaredMethod) downloadVerified(body io.Reader, acq *AcquireRequest, offset int64) (*hashes, error) {
+	sums, err := download(body, acq.Filename, offset, acq.MaximumSize)
+	if err == nil {
+		if verr := sums.Verify(acq.ExpectedHashes); verr != nil {
+			err = &URIFailure{
+				Err:    fmt.Errorf("hash sum mismatch for %s: %v", acq.URI, verr),
+				Reason: "HashSumMismatch",
+				Fields: sums.Fields(),
+			}
+		}
+	}
 
-	cfd.mwriter.FinishURI(requrl, filename, "", "", false, false,
-		Field{"MD5-Hash", strMD5},
-		Field{"MD5Sum-Hash", strMD5},
-		Field{"SHA1-Hash", strSHA1},
-		Field{"SHA256-Hash", strSHA256},
-		Field{"SHA512-Hash", strSHA512},
-	)
+	if _, ok := err.(*URIFailure); ok {
+		cfd.removeDownload(acq)
+	}
+	return sums, err
+}
 
-	return nil
+// removeDownload removes the file apt asked for, if a download can't be
+// resumed.
+func (cfd *CloudflaredMethod) removeDownload(acq *AcquireRequest) {
+	if err := os.Remove(acq.Filename); err != nil && !os.IsNotExist(err) {
+		cfd.mwriter.Logf("Unable to remove %s: %v", acq.Filename, err)
+	}
+}
+
+// saveValidators records the Last-Modified time and ETag of a downloaded
+// resource, and returns the fields to report them to apt with.
+//
+// The modification time of the downloaded file is set to the Last-Modified
+// time, as apt uses it for the next If-Modified-Since request, and it is used
+// in the If-Range of a request to resume the file.
+func (cfd *CloudflaredMethod) saveValidators(resp *http.Response, acq *AcquireRequest) []Field {
+	lastModified := resp.Header.Get("Last-Modified")
+	modtime, err := http.ParseTime(lastModified)
+
+	// Without a Last-Modified time there is no telling which copy an ETag
+	// belongs to later
+	if etag := resp.Header.Get("ETag"); etag != "" && err == nil {
+		if err := cfd.etags.Set(acq.URI, etag, modtime); err != nil {
+			cfd.mwriter.Logf("Unable to save ETag for %s: %v", acq.URI, err)
+		}
+	}
+	if err != nil {
+		return nil
+	}
+
+	if err := os.Chtimes(acq.Filename, modtime, modtime); err != nil && !os.IsNotExist(err) {
+		cfd.mwriter.Logf("Unable to set modification time of %s: %v", acq.Filename, err)
+	}
+	return []Field{{"Last-Modified", lastModified}}
 }
 
 // ParseConfig takes a config message from apt and sets config values from it.
 func (cfd *CloudflaredMethod) ParseConfig(msg *Message) error {
 	cfd.mwriter.Log("cfd: Parsing config:")
-	for k, v := range msg.Fields {
-		msg := fmt.Sprintf("cfd:    %s %s", k, v)
+	for _, field := range msg.Fields {
+		msg := fmt.Sprintf("cfd:    %s %s", field.Key, field.Value)
 		cfd.mwriter.Log(msg)
 	}
-	return nil
+
+	for _, item := range msg.GetAll("Config-Item") {
+		if err := cfd.config.Set(item); err != nil {
+			return err
+		}
+	}
+	return cfd.config.Validate()
 }
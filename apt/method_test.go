@@ -2,8 +2,25 @@ package apt
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/qr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -16,4 +33,890 @@ func TestParseConfig(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected no error with valid config, got %v", err)
 	}
+
+	msg = NewMessage(601, "Configuration", Field{"Config-Item", "Acquire::cfd+https::Timeout=10"})
+	err = method.ParseConfig(msg)
+	if err != nil {
+		t.Errorf("Expected no error with valid config, got %v", err)
+	}
+	if method.config.Timeout != 10*time.Second {
+		t.Errorf("Expected timeout to be set from config, got %v", method.config.Timeout)
+	}
+
+	msg = NewMessage(601, "Configuration",
+		Field{"Config-Item", "Acquire::cfd+https::Retries=3"},
+		Field{"Config-Item", "Acquire::cfd+https::Workers=2"})
+	err = method.ParseConfig(msg)
+	if err != nil {
+		t.Errorf("Expected no error with valid config, got %v", err)
+	}
+	if method.config.Retries != 3 || method.config.Workers != 2 {
+		t.Errorf("Expected every config item to be applied, got %+v", method.config)
+	}
+
+	msg = NewMessage(601, "Configuration", Field{"Config-Item", "Acquire::cfd+https::Timeout=never"})
+	err = method.ParseConfig(msg)
+	if err == nil {
+		t.Errorf("Expected error with invalid config")
+	}
+}
+
+func TestShowAuthURL(t *testing.T) {
+	tests := []struct {
+		output string
+		status uint64
+	}{
+		{"", 104},
+		{"status", 102},
+		{"warning", 104},
+	}
+
+	for _, test := range tests {
+		var output strings.Builder
+		method, err := NewCloudflaredMethod(nil, &output, bufio.NewReader(strings.NewReader("")))
+		require.NoError(t, err)
+		if test.output != "" {
+			require.NoError(t, method.config.Set("Acquire::cfd+https::Auth-URL-Output="+test.output))
+		}
+
+		fmt.Fprintln(method.urlwriter, "Please open https://apt.example.com/cdn-cgi/access/cli?token=1 to log in")
+		fmt.Fprintln(method.urlwriter, "A browser opened https://apt.example.com/cdn-cgi/access/cli?token=1")
+
+		msgs := readMessages(t, output.String())
+		require.Len(t, msgs, 1, test.output)
+		assert.Equal(t, test.status, msgs[0].StatusCode, test.output)
+		assert.Equal(t, "Auth URL: https://apt.example.com/cdn-cgi/access/cli?token=1", msgs[0].Get("Message"))
+	}
+}
+
+func TestShowAuthURLQR(t *testing.T) {
+	const url = "https://apt.example.com/cdn-cgi/access/cli?token=1"
+	code, err := qr.Encode(url, qr.Low)
+	require.NoError(t, err)
+
+	var tty bytes.Buffer
+	ttyErr := errors.New("no controlling terminal")
+	defer func(orig func() (io.WriteCloser, error)) { openTTY = orig }(openTTY)
+	openTTY = func() (io.WriteCloser, error) {
+		if ttyErr != nil {
+			return nil, ttyErr
+		}
+		return nopCloser{&tty}, nil
+	}
+
+	var output strings.Builder
+	method, err := NewCloudflaredMethod(nil, &output, bufio.NewReader(strings.NewReader("")))
+	require.NoError(t, err)
+	require.NoError(t, method.config.Set("Acquire::cfd+https::Auth-URL-QR=tty"))
+
+	// Without a terminal, there is a warning instead of the code
+	fmt.Fprintln(method.urlwriter, url)
+	msgs := readMessages(t, output.String())
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "Auth URL: "+url, msgs[0].Get("Message"))
+	assert.Equal(t, uint64(104), msgs[1].StatusCode)
+	assert.Contains(t, msgs[1].Get("Message"), "no controlling terminal")
+	assert.Empty(t, tty.String())
+
+	output.Reset()
+	method, err = NewCloudflaredMethod(nil, &output, bufio.NewReader(strings.NewReader("")))
+	require.NoError(t, err)
+	require.NoError(t, method.config.Set("Acquire::cfd+https::Auth-URL-QR=tty"))
+	ttyErr = nil
+
+	fmt.Fprintln(method.urlwriter, url)
+	assert.Len(t, readMessages(t, output.String()), 1)
+	assert.Equal(t, "\r\n"+code.String(), tty.String())
+}
+
+// nopCloser is an io.WriteCloser whose Close does nothing.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// newTestMethod creates a method which talks to the given test server and
+// uses a service token for the server's host.
+func newTestMethod(t *testing.T, srv *httptest.Server, input string) (*CloudflaredMethod, *strings.Builder) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cfd-method-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	err = ioutil.WriteFile(filepath.Join(dir, host+"-Service-Token"), []byte("id.access\nsecret\n"), 0600)
+	require.NoError(t, err)
+
+	var output strings.Builder
+	method, err := NewCloudflaredMethod(srv.Client(), &output, bufio.NewReader(strings.NewReader(input)))
+	require.NoError(t, err)
+	method.config.SystemTokenDir = ""
+	method.config.ServiceTokenDir = dir
+
+	return method, &output
+}
+
+// readMessages parses all of the messages written by the method.
+func readMessages(t *testing.T, output string) []*Message {
+	t.Helper()
+
+	var msgs []*Message
+	reader := NewMessageReader(bufio.NewReader(strings.NewReader(output)))
+	for {
+		msg, err := reader.ReadMessage()
+		if err == io.EOF {
+			return msgs
+		}
+		require.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+}
+
+// uriMessages filters out everything but the URI status messages.
+func uriMessages(msgs []*Message) []*Message {
+	var filtered []*Message
+	for _, msg := range msgs {
+		if msg.StatusCode >= 200 {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+func TestRunPipelined(t *testing.T) {
+	var inflight, maxInflight int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+
+		assert.Equal(t, "secret", r.Header.Get("Cf-Access-Client-Secret"))
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, "contents of %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	input := "601 Configuration\nConfig-Item: Acquire::cfd+https::Workers=2\n\n"
+	uris := make(map[string]string)
+	for i := 0; i < 6; i++ {
+		uri := fmt.Sprintf("cfd+%s/file-%d", srv.URL, i)
+		filename := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+		uris[uri] = filename
+		input += fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\n\n", uri, filename)
+	}
+
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxInflight))
+
+	msgs := readMessages(t, output.String())
+	require.NotEmpty(t, msgs)
+	assert.Equal(t, "true", msgs[0].Get("Pipeline"))
+
+	started := make(map[string]int)
+	for _, msg := range msgs {
+		uri := msg.Get("URI")
+		switch msg.StatusCode {
+		case 200:
+			started[uri]++
+		case 201:
+			assert.Equal(t, 1, started[uri], "URI %s finished without exactly one start", uri)
+			assert.Equal(t, uris[uri], msg.Get("Filename"))
+			delete(uris, uri)
+		case 400:
+			t.Errorf("Unexpected failure for %s", uri)
+		}
+	}
+	assert.Empty(t, uris, "Not all URIs were acquired")
+}
+
+func TestAcquireReauthenticates(t *testing.T) {
+	var tokenfile string
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/cdn-cgi/access/login") {
+			fmt.Fprint(w, "<html>Sign in</html>")
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Cf-Access-Client-Secret") != "new-secret" {
+			// Rotate the token on disk, as if the old one had been revoked
+			data := []byte("id.access\nnew-secret\n")
+			assert.NoError(t, ioutil.WriteFile(tokenfile, data, 0600))
+			http.Redirect(w, r, "/cdn-cgi/access/login/"+r.Host, http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "package")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "reauth")
+
+	input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: %s\n\n", srv.URL, filename)
+	method, output := newTestMethod(t, srv, input)
+	tokenfile = filepath.Join(method.config.ServiceTokenDir, strings.TrimPrefix(srv.URL, "https://")+"-Service-Token")
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.Len(t, msgs, 2)
+	assert.Equal(t, uint64(201), msgs[1].StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestAcquireAuthFailure(t *testing.T) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("CF-Access-Aud", "aud-1")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: /nonexistent\n\n", srv.URL)
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.Len(t, msgs, 2)
+	assert.Equal(t, uint64(200), msgs[0].StatusCode)
+	assert.Equal(t, uint64(400), msgs[1].StatusCode)
+	assert.Equal(t, "AuthFailure", msgs[1].Get("FailReason"))
+	assert.Contains(t, msgs[1].Get("Message"), "authentication failed")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestAcquireOriginForbidden(t *testing.T) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	// A 403 from the origin isn't a rejected token, so no new token is fetched
+	input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: /nonexistent\n\n", srv.URL)
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.Len(t, msgs, 2)
+	assert.Equal(t, uint64(400), msgs[1].StatusCode)
+	assert.Equal(t, "HttpError403", msgs[1].Get("FailReason"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestAcquireLoginRequired(t *testing.T) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer srv.Close()
+
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::cfd+https::Providers=service-token,cloudflared\n" +
+		"Config-Item: Acquire::cfd+https::Cloudflared=/bin/false\n" +
+		"Config-Item: Acquire::cfd+https::Interactive=false\n\n" +
+		fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: /nonexistent\n\n", srv.URL)
+	method, output := newTestMethod(t, srv, input)
+	method.config.ServiceTokenDir = ""
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.NotEmpty(t, msgs)
+	failure := msgs[len(msgs)-1]
+	assert.Equal(t, uint64(400), failure.StatusCode)
+	assert.Equal(t, "AuthFailure", failure.Get("FailReason"))
+	assert.Contains(t, failure.Get("Message"), "not interactive")
+	assert.Contains(t, failure.Get("Message"), "service token")
+	assert.Contains(t, failure.Get("Message"), "open "+srv.URL+"/ in a browser to log in")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
+
+func TestAcquireHelperTimeout(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::cfd+https::Providers=credential-helper\n" +
+		"Config-Item: Acquire::cfd+https::Credential-Helper=/bin/sleep\n" +
+		"Config-Item: Acquire::cfd+https::Credential-Helper-Args=5\n" +
+		"Config-Item: Acquire::cfd+https::Credential-Helper-Timeout=1\n\n" +
+		fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: /nonexistent\n\n", srv.URL)
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.NotEmpty(t, msgs)
+	failure := msgs[len(msgs)-1]
+	assert.Equal(t, uint64(400), failure.StatusCode)
+	assert.Contains(t, failure.Get("Message"), "credential helper /bin/sleep timed out after 1s")
+	assert.Contains(t, failure.Get("Message"), "set Acquire::cfd+https::Credential-Helper-Timeout")
+}
+
+func TestAcquireHelperStderr(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-helper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "helper")
+	require.NoError(t, ioutil.WriteFile(script, []byte("printf 'line1\\n\\nline3\\n' >&2\nexit 1\n"), 0644))
+
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::cfd+https::Providers=credential-helper\n" +
+		"Config-Item: Acquire::cfd+https::Credential-Helper=/bin/sh\n" +
+		"Config-Item: Acquire::cfd+https::Credential-Helper-Args=" + script + "\n\n" +
+		fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: /nonexistent\n\n", srv.URL)
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	// The helper's output is kept on the line of the message, so the
+	// failure reason isn't lost
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.NotEmpty(t, msgs)
+	failure := msgs[len(msgs)-1]
+	assert.Equal(t, uint64(400), failure.StatusCode)
+	assert.Equal(t, "AuthFailure", failure.Get("FailReason"))
+	assert.Contains(t, failure.Get("Message"), "exit status 1: line1 line3")
+}
+
+func TestAcquireInsecureToken(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "package")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "insecure")
+
+	input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: %s\n\n", srv.URL, filename)
+	method, output := newTestMethod(t, srv, input)
+	tokenfile := filepath.Join(method.config.ServiceTokenDir, strings.TrimPrefix(srv.URL, "https://")+"-Service-Token")
+	require.NoError(t, os.Chmod(tokenfile, 0644))
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.NotEmpty(t, msgs)
+	failure := msgs[len(msgs)-1]
+	assert.Equal(t, uint64(400), failure.StatusCode)
+	assert.Equal(t, "AuthFailure", failure.Get("FailReason"))
+	assert.Contains(t, failure.Get("Message"), "refusing to use insecure token file "+tokenfile)
+	assert.Contains(t, failure.Get("Message"), "Allow-Insecure-Tokens")
+
+	// With the override, the token is used with a warning
+	input = "601 Configuration\nConfig-Item: Acquire::cfd+https::Allow-Insecure-Tokens=true\n\n" + input
+	method, output = newTestMethod(t, srv, input)
+	tokenfile = filepath.Join(method.config.ServiceTokenDir, strings.TrimPrefix(srv.URL, "https://")+"-Service-Token")
+	require.NoError(t, os.Chmod(tokenfile, 0644))
+	require.True(t, method.Run())
+
+	var warnings []string
+	for _, msg := range readMessages(t, output.String()) {
+		if msg.StatusCode == 104 {
+			warnings = append(warnings, msg.Get("Message"))
+		}
+	}
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "Using insecure token file "+tokenfile)
+
+	msgs = uriMessages(readMessages(t, output.String()))
+	require.NotEmpty(t, msgs)
+	assert.Equal(t, uint64(201), msgs[len(msgs)-1].StatusCode)
+}
+
+func TestAcquireLoginPage(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "CF_AppSession", Value: "abc123"})
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		fmt.Fprint(w, "<html>Sign in with Cloudflare Access</html>")
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "login-page")
+
+	input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: %s\n\n", srv.URL, filename)
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.Len(t, msgs, 2)
+	assert.Equal(t, uint64(400), msgs[1].StatusCode)
+	assert.Equal(t, "AuthFailure", msgs[1].Get("FailReason"))
+	assert.Contains(t, msgs[1].Get("Message"), "log in at "+srv.URL+"/")
+
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "Login page was written to %s", filename)
+}
+
+func TestAcquireUserAgent(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("User-Agent"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	filename := filepath.Join(dir, "agent")
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::cfd+https::" + host + "::User-Agent=cfd-test%2f1.0\n\n" +
+		fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/agent\nFilename: %s\n\n", srv.URL, filename)
+
+	method, output := newTestMethod(t, srv, input)
+	require.True(t, method.Run())
+
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "cfd-test/1.0", string(data))
+	assert.Contains(t, output.String(), "Using token for "+host+" from service-token")
+}
+
+func TestShowIdentity(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "Shown Once",
+			expected: []string{"Access identity for " + host + ": service token id.access (from service-token)"},
+		},
+		{
+			name:   "Disabled",
+			config: "Config-Item: Acquire::cfd+https::Show-Identity=no\n",
+		},
+		{
+			name:   "Disabled For Host",
+			config: "Config-Item: Acquire::cfd+https::" + host + "::Show-Identity=no\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cfd-method-files")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			input := "601 Configuration\n" + test.config + "\n"
+			for i := 0; i < 3; i++ {
+				input += fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/file-%d\nFilename: %s\n\n",
+					srv.URL, i, filepath.Join(dir, fmt.Sprintf("file-%d", i)))
+			}
+
+			method, output := newTestMethod(t, srv, input)
+			require.True(t, method.Run())
+
+			var shown []string
+			for _, msg := range readMessages(t, output.String()) {
+				if msg.StatusCode == 102 && strings.HasPrefix(msg.Get("Message"), "Access identity") {
+					shown = append(shown, msg.Get("Message"))
+				}
+			}
+			assert.Equal(t, test.expected, shown)
+			assert.NotContains(t, output.String(), "secret")
+		})
+	}
+}
+
+func TestAcquireIfModifiedSince(t *testing.T) {
+	modtime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "InRelease", modtime, strings.NewReader("release file"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uri := "cfd+" + srv.URL + "/dists/stable/InRelease"
+	acquire := func(filename string, lastModified time.Time) string {
+		msg := fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\n", uri, filepath.Join(dir, filename))
+		if !lastModified.IsZero() {
+			msg += "Last-Modified: " + lastModified.Format(http.TimeFormat) + "\n"
+		}
+		return msg + "\n"
+	}
+
+	input := acquire("full", time.Time{}) +
+		acquire("ims-hit", modtime) +
+		acquire("ims-miss", modtime.Add(-time.Hour))
+
+	method, output := newTestMethod(t, srv, input)
+	method.config.Workers = 1
+	require.True(t, method.Run())
+
+	msgs := uriMessages(readMessages(t, output.String()))
+	require.Len(t, msgs, 6)
+
+	// Full download reports the Last-Modified time and sets the file's mtime
+	full := msgs[1]
+	assert.Equal(t, uint64(201), full.StatusCode)
+	assert.Equal(t, "", full.Get("IMS-Hit"))
+	assert.Equal(t, modtime.Format(http.TimeFormat), full.Get("Last-Modified"))
+	info, err := os.Stat(filepath.Join(dir, "full"))
+	require.NoError(t, err)
+	assert.True(t, modtime.Equal(info.ModTime()), "Unexpected mtime %v", info.ModTime())
+
+	// Not modified since apt's copy
+	hit := msgs[3]
+	assert.Equal(t, uint64(201), hit.StatusCode)
+	assert.Equal(t, "true", hit.Get("IMS-Hit"))
+	_, err = os.Stat(filepath.Join(dir, "ims-hit"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Apt's copy is older, so the ETag from the first download isn't sent
+	// for it and the resource is downloaded again
+	miss := msgs[5]
+	assert.Equal(t, uint64(201), miss.StatusCode)
+	assert.Equal(t, "", miss.Get("IMS-Hit"))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "ims-miss"))
+	require.NoError(t, err)
+	assert.Equal(t, "release file", string(data))
+}
+
+func TestAcquireResume(t *testing.T) {
+	modtime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	content := strings.Repeat("0123456789", 1000)
+	var ranges []string
+	var rangesMu sync.Mutex
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		rangesMu.Unlock()
+
+		if r.URL.Path == "/bad-range" && r.Header.Get("Range") != "" {
+			// Return a range starting at the wrong offset
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-9/%d", len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, content[:10])
+			return
+		}
+		http.ServeContent(w, r, "pkg.deb", modtime, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expected := newHashes()
+	io.WriteString(expected, content)
+	sha256 := expected.Fields()[3].Value
+
+	tests := []struct {
+		name        string
+		path        string
+		partial     string
+		modtime     time.Time
+		resumePoint string
+		rangeHeader string
+	}{
+		{"Resumed", "/pkg.deb", content[:4000], modtime, "4000", "bytes=4000-"},
+		{"Complete", "/pkg.deb", content, modtime, "10000", "bytes=10000-"},
+		{"Changed", "/pkg.deb", content[:4000], modtime.Add(time.Hour), "", "bytes=4000-"},
+		{"Bad Range", "/bad-range", content[:4000], modtime, "", "bytes=4000-"},
+		{"Corrupt Prefix", "/pkg.deb", "xxxx", modtime.Add(-time.Hour), "", "bytes=4-"},
+		{"No Partial", "/pkg.deb", "", modtime, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges = nil
+			filename := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+			if test.partial != "" {
+				require.NoError(t, ioutil.WriteFile(filename, []byte(test.partial), 0644))
+				require.NoError(t, os.Chtimes(filename, test.modtime, test.modtime))
+			}
+
+			input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s%s\nFilename: %s\n\n", srv.URL, test.path, filename)
+			method, output := newTestMethod(t, srv, input)
+			require.True(t, method.Run())
+
+			msgs := uriMessages(readMessages(t, output.String()))
+			require.Len(t, msgs, 2)
+			assert.Equal(t, uint64(200), msgs[0].StatusCode)
+			assert.Equal(t, test.resumePoint, msgs[0].Get("Resume-Point"))
+			assert.Equal(t, "10000", msgs[0].Get("Size"))
+			assert.Equal(t, uint64(201), msgs[1].StatusCode)
+			assert.Equal(t, test.resumePoint, msgs[1].Get("Resume-Point"))
+			assert.Equal(t, sha256, msgs[1].Get("SHA256-Hash"))
+			assert.Equal(t, test.rangeHeader, ranges[0])
+
+			data, err := ioutil.ReadFile(filename)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(data))
+		})
+	}
+}
+
+func TestAcquireRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		requests   int32
+		reason     string
+		transient  bool
+	}{
+		{
+			name:     "Server Error",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusOK},
+			requests: 2,
+		},
+		{
+			name:       "Too Many Requests",
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter: "0",
+			requests:   2,
+		},
+		{
+			name:      "Gives Up",
+			statuses:  []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			requests:  3,
+			reason:    "HttpError502",
+			transient: true,
+		},
+		{
+			name:       "Long Retry-After",
+			statuses:   []int{http.StatusTooManyRequests},
+			retryAfter: "3600",
+			requests:   1,
+			reason:     "HttpError429",
+			transient:  true,
+		},
+		{
+			name:     "Not Found",
+			statuses: []int{http.StatusNotFound},
+			requests: 1,
+			reason:   "HttpError404",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				status := test.statuses[len(test.statuses)-1]
+				if int(n) <= len(test.statuses) {
+					status = test.statuses[n-1]
+				}
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(status)
+				fmt.Fprint(w, "contents")
+			}))
+			defer srv.Close()
+
+			dir, err := ioutil.TempDir("", "cfd-method-files")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			filename := filepath.Join(dir, "pkg.deb")
+			input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: %s\n\n", srv.URL, filename)
+			method, output := newTestMethod(t, srv, input)
+			method.config.Retries = 2
+			method.config.RetryDelay = time.Millisecond
+			require.True(t, method.Run())
+
+			msgs := uriMessages(readMessages(t, output.String()))
+			require.Len(t, msgs, 2)
+			assert.Equal(t, uint64(200), msgs[0].StatusCode)
+			assert.Equal(t, test.requests, atomic.LoadInt32(&requests))
+
+			if test.reason == "" {
+				assert.Equal(t, uint64(201), msgs[1].StatusCode)
+				data, err := ioutil.ReadFile(filename)
+				require.NoError(t, err)
+				assert.Equal(t, "contents", string(data))
+				return
+			}
+
+			assert.Equal(t, uint64(400), msgs[1].StatusCode)
+			assert.Equal(t, test.reason, msgs[1].Get("FailReason"))
+			if test.transient {
+				assert.Equal(t, "true", msgs[1].Get("Transient-Failure"))
+			} else {
+				assert.Empty(t, msgs[1].Get("Transient-Failure"))
+			}
+		})
+	}
+}
+
+func TestAcquireInterrupted(t *testing.T) {
+	modtime := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	content := strings.Repeat("0123456789", 1000)
+
+	tests := []struct {
+		name   string
+		cuts   int32
+		ranges []string
+		reason string
+	}{
+		{name: "Resumed", cuts: 1, ranges: []string{"", "bytes=5000-"}},
+		{name: "Gives Up", cuts: 3, ranges: []string{"", "bytes=5000-", "bytes=5000-"}, reason: "ConnectionFailed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			var ranges []string
+			var rangesMu sync.Mutex
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rangesMu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				rangesMu.Unlock()
+
+				if atomic.AddInt32(&requests, 1) > test.cuts {
+					http.ServeContent(w, r, "pkg.deb", modtime, strings.NewReader(content))
+					return
+				}
+
+				// Send half of the file, then cut the connection
+				w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.WriteHeader(http.StatusOK)
+				io.WriteString(w, content[:5000])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}))
+			defer srv.Close()
+
+			dir, err := ioutil.TempDir("", "cfd-method-files")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			filename := filepath.Join(dir, "pkg.deb")
+			input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s/pkg.deb\nFilename: %s\n\n", srv.URL, filename)
+			method, output := newTestMethod(t, srv, input)
+			method.config.Retries = 2
+			method.config.RetryDelay = time.Millisecond
+			require.True(t, method.Run())
+
+			// apt is only told about the start of the download once
+			msgs := uriMessages(readMessages(t, output.String()))
+			require.Len(t, msgs, 2)
+			assert.Equal(t, uint64(200), msgs[0].StatusCode)
+			assert.Equal(t, "10000", msgs[0].Get("Size"))
+			assert.Equal(t, test.ranges, ranges)
+
+			data, err := ioutil.ReadFile(filename)
+			require.NoError(t, err)
+
+			if test.reason == "" {
+				assert.Equal(t, uint64(201), msgs[1].StatusCode)
+				assert.Empty(t, msgs[1].Get("Resume-Point"))
+				assert.Equal(t, content, string(data))
+				return
+			}
+
+			// The partial file is left for apt to resume
+			assert.Equal(t, uint64(400), msgs[1].StatusCode)
+			assert.Equal(t, test.reason, msgs[1].Get("FailReason"))
+			assert.Equal(t, "true", msgs[1].Get("Transient-Failure"))
+			assert.Equal(t, content[:5000], string(data))
+		})
+	}
+}
+
+func TestAcquireVerify(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/streamed" {
+			// Flushing before writing the body leaves out the Content-Length
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cfd-method-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expected := newHashes()
+	io.WriteString(expected, content)
+	sha256, sha512 := expected.Fields()[3].Value, expected.Fields()[4].Value
+
+	tests := []struct {
+		name    string
+		path    string
+		fields  string
+		reason  string
+		partial string
+	}{
+		{"Matching Hashes", "/pkg.deb", "Expected-SHA256: " + sha256 + "\nExpected-SHA512: " + sha512 + "\n", "", ""},
+		{"Hash Mismatch", "/pkg.deb", "Expected-SHA256: " + sha256 + "\nExpected-SHA512: 00\n", "HashSumMismatch", ""},
+		{"Within Maximum Size", "/streamed", "Maximum-Size: 1000\n", "", ""},
+		{"Too Large", "/pkg.deb", "Maximum-Size: 999\n", "MaximumSizeExceeded", ""},
+		{"Streamed Too Large", "/streamed", "Maximum-Size: 999\n", "MaximumSizeExceeded", ""},
+		{"Too Large To Resume", "/pkg.deb", "Maximum-Size: 999\n", "MaximumSizeExceeded", content[:100]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+			if test.partial != "" {
+				require.NoError(t, ioutil.WriteFile(filename, []byte(test.partial), 0644))
+			}
+			input := fmt.Sprintf("600 URI Acquire\nURI: cfd+%s%s\nFilename: %s\n%s\n",
+				srv.URL, test.path, filename, test.fields)
+			method, output := newTestMethod(t, srv, input)
+			require.True(t, method.Run())
+
+			msgs := uriMessages(readMessages(t, output.String()))
+			require.Len(t, msgs, 2)
+			assert.Equal(t, uint64(200), msgs[0].StatusCode)
+
+			if test.reason == "" {
+				assert.Equal(t, uint64(201), msgs[1].StatusCode)
+				assert.Equal(t, sha256, msgs[1].Get("SHA256-Hash"))
+				return
+			}
+
+			assert.Equal(t, uint64(400), msgs[1].StatusCode)
+			assert.Equal(t, test.reason, msgs[1].Get("FailReason"))
+			assert.Empty(t, msgs[1].Get("Transient-Failure"))
+			if test.reason == "HashSumMismatch" {
+				assert.Equal(t, sha256, msgs[1].Get("SHA256-Hash"))
+			}
+
+			_, err := os.Stat(filename)
+			assert.True(t, os.IsNotExist(err), "%s was not removed", filename)
+		})
+	}
 }
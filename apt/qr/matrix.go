@@ -0,0 +1,304 @@
+package qr
+
+// newCode creates a code of the given version with its function patterns
+// drawn: the finder, timing and alignment patterns, and the version
+// information. The format information is reserved, but is only drawn once
+// the mask is known.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	c := &Code{
+		Size:     size,
+		Version:  version,
+		Level:    level,
+		modules:  make([]bool, size*size),
+		function: make([]bool, size*size),
+	}
+
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	align := alignmentPositions(version)
+	last := len(align) - 1
+	for i, x := range align {
+		for j, y := range align {
+			// The corners with finder patterns have no alignment patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format information until the mask is known
+	c.drawFormat(0)
+	c.drawVersion()
+	return c
+}
+
+// setFunction sets the module in column x and row y as part of a function
+// pattern, which data is never written to.
+func (c *Code) setFunction(x, y int, black bool) {
+	c.modules[y*c.Size+x] = black
+	c.function[y*c.Size+x] = true
+}
+
+// drawFinder draws a finder pattern centered on the module in column x and
+// row y, along with the separator around it, which is clipped to the code.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			dist := maxAbs(dx, dy)
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centered on the module in column
+// x and row y.
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, maxAbs(dx, dy) != 1)
+		}
+	}
+}
+
+// formatInfo returns the 15 bits of format information for the level and
+// mask: the level and mask followed by a BCH(15,5) code, XORed with a fixed
+// pattern so that they are never all zero.
+func formatInfo(level Level, mask int) int {
+	data := formatBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionInfo returns the 18 bits of version information for the version:
+// the version followed by a BCH(18,6) code.
+func versionInfo(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return version<<12 | rem
+}
+
+// drawFormat draws both copies of the format information for the code's
+// level and the mask, and the dark module next to the second copy.
+func (c *Code) drawFormat(mask int) {
+	bits := formatInfo(c.Level, mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// Around the top left finder pattern, skipping the timing patterns
+	for i := 0; i < 6; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	// Split between the top right and bottom left finder patterns
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// drawVersion draws both copies of the version information, which only codes
+// of version 7 and up have.
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+
+	bits := versionInfo(c.Version)
+	for i := 0; i < 18; i++ {
+		black := (bits>>uint(i))&1 != 0
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, black)
+		c.setFunction(b, a, black)
+	}
+}
+
+// drawCodewords writes the codewords into the modules which aren't part of a
+// function pattern. They are written in pairs of columns from the right,
+// zigzagging up and down, and skipping the vertical timing pattern. Any
+// remainder bits are left light.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for x := right; x > right-2; x-- {
+				if c.function[y*c.Size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = codewords[i/8]>>uint(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// masks are the conditions under which each mask pattern inverts the module
+// in column x and row y.
+var masks = [8]func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+// applyMask inverts the data modules chosen by the mask pattern. Applying the
+// same mask again undoes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y*c.Size+x] && masks[mask](x, y) {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// bestMask returns the mask pattern which gives the code the lowest penalty.
+func (c *Code) bestMask() int {
+	best, bestPenalty := 0, -1
+	for mask := range masks {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask)
+	}
+	return best
+}
+
+// The penalty weights for the features which make a code harder to read.
+const (
+	penaltyRun     = 3
+	penaltyBlock   = 3
+	penaltyFinder  = 40
+	penaltyBalance = 10
+)
+
+// penalty scores how hard the code is to read: long runs of modules of the
+// same color, 2x2 blocks of the same color, patterns which look like finder
+// patterns, and an imbalance between dark and light modules.
+func (c *Code) penalty() int {
+	penalty := 0
+	for i := 0; i < c.Size; i++ {
+		row := func(j int) bool { return c.Black(j, i) }
+		col := func(j int) bool { return c.Black(i, j) }
+		penalty += c.linePenalty(row) + c.linePenalty(col)
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			black := c.Black(x, y)
+			if black {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && black == c.Black(x+1, y) &&
+				black == c.Black(x, y+1) && black == c.Black(x+1, y+1) {
+				penalty += penaltyBlock
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	percent := dark * 100 / total
+	return penalty + penaltyBalance*(abs(percent-50)/5)
+}
+
+// finderLike is the 1:1:3:1:1 pattern of a finder pattern, which codes
+// shouldn't contain next to four light modules.
+var finderLike = []bool{true, false, true, true, true, false, true}
+
+// linePenalty scores a single row or column, whose modules are given by
+// module, for runs of five or more modules of the same color and for
+// patterns which look like finder patterns.
+func (c *Code) linePenalty(module func(int) bool) int {
+	penalty := 0
+	run := 1
+	for j := 1; j <= c.Size; j++ {
+		if j < c.Size && module(j) == module(j-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += penaltyRun + run - 5
+		}
+		run = 1
+	}
+
+	// The quiet zone around the code counts as light modules
+	light := func(from, to int) bool {
+		for k := from; k < to; k++ {
+			if module(k) {
+				return false
+			}
+		}
+		return true
+	}
+	for j := 0; j+len(finderLike) <= c.Size; j++ {
+		match := true
+		for k, black := range finderLike {
+			if module(j+k) != black {
+				match = false
+				break
+			}
+		}
+		if match && (light(j-4, j) || light(j+7, j+11)) {
+			penalty += penaltyFinder
+		}
+	}
+	return penalty
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// maxAbs returns the larger of the absolute values of x and y, which is the
+// distance of a module from the center of a square pattern.
+func maxAbs(x, y int) int {
+	if abs(x) > abs(y) {
+		return abs(x)
+	}
+	return abs(y)
+}
@@ -0,0 +1,202 @@
+// Package qr encodes text as QR codes, and renders them with the block
+// characters of a terminal.
+//
+// Only the byte mode is used, which can hold any text, such as the URLs the
+// method shows to users who need to log in to Access.
+package qr
+
+import "fmt"
+
+// Level is an error correction level. Higher levels can recover from more
+// damage, at the cost of a larger code.
+type Level int
+
+// The error correction levels, which can recover from about 7%, 15%, 25% and
+// 30% of the codewords being damaged.
+const (
+	Low Level = iota
+	Medium
+	Quartile
+	High
+)
+
+// formatBits are the bits which identify each level in the format
+// information.
+var formatBits = [4]int{Low: 1, Medium: 0, Quartile: 3, High: 2}
+
+func (l Level) String() string {
+	switch l {
+	case Low:
+		return "L"
+	case Medium:
+		return "M"
+	case Quartile:
+		return "Q"
+	case High:
+		return "H"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Code is a QR code.
+type Code struct {
+	// Size is the width and height of the code in modules, without the
+	// quiet zone around it.
+	Size int
+
+	// Version is the version of the code, from 1 to 40, which sets its size.
+	Version int
+
+	// Level is the error correction level of the code.
+	Level Level
+
+	// Mask is the mask pattern applied to the code, from 0 to 7.
+	Mask int
+
+	modules  []bool
+	function []bool
+}
+
+// Encode encodes the text as the smallest QR code with the given error
+// correction level which can hold it, using the mask pattern which makes it
+// easiest to read.
+func Encode(text string, level Level) (*Code, error) {
+	return encode([]byte(text), level, -1)
+}
+
+// encode encodes the data as the smallest QR code which can hold it. If mask
+// is negative, the best mask pattern is chosen, and otherwise the given one
+// is used.
+func encode(data []byte, level Level, mask int) (*Code, error) {
+	if level < Low || level > High {
+		return nil, fmt.Errorf("invalid error correction level %d", int(level))
+	}
+
+	version := 1
+	for ; version <= 40; version++ {
+		if dataBits(len(data), version) <= dataCodewords(version, level)*8 {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, fmt.Errorf("%d bytes are too many for a QR code with error correction level %s",
+			len(data), level)
+	}
+
+	code := newCode(version, level)
+	code.drawCodewords(code.addECC(code.encodeData(data)))
+
+	if mask < 0 {
+		mask = code.bestMask()
+	}
+	code.applyMask(mask)
+	code.drawFormat(mask)
+	code.Mask = mask
+	return code, nil
+}
+
+// Black reports whether the module in column x and row y is dark. Modules
+// outside of the code, in the quiet zone, are light.
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y*c.Size+x]
+}
+
+// countBits returns the length of the character count in the byte mode for
+// the given version.
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// dataBits returns the number of bits needed to encode n bytes in the byte
+// mode in a code of the given version, without the terminator and padding.
+func dataBits(n, version int) int {
+	if n >= 1<<uint(countBits(version)) {
+		return 1 << 30
+	}
+	return 4 + countBits(version) + 8*n
+}
+
+// bitBuffer collects the bits of the data codewords.
+type bitBuffer struct {
+	bytes []byte
+	n     int
+}
+
+// write appends the low count bits of value, from the highest down.
+func (b *bitBuffer) write(value, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if (value>>uint(i))&1 != 0 {
+			b.bytes[b.n/8] |= 0x80 >> uint(b.n%8)
+		}
+		b.n++
+	}
+}
+
+// encodeData returns the data codewords for the data: the byte mode segment,
+// the terminator and the padding.
+func (c *Code) encodeData(data []byte) []byte {
+	capacity := dataCodewords(c.Version, c.Level) * 8
+
+	var b bitBuffer
+	b.write(0x4, 4)
+	b.write(len(data), countBits(c.Version))
+	for _, d := range data {
+		b.write(int(d), 8)
+	}
+
+	terminator := capacity - b.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	b.write(0, terminator)
+	b.write(0, (8-b.n%8)%8)
+
+	for pad := 0xec; b.n < capacity; pad ^= 0xec ^ 0x11 {
+		b.write(pad, 8)
+	}
+	return b.bytes
+}
+
+// addECC splits the data codewords into blocks, adds the error correction
+// codewords to each and interleaves them into the final sequence of
+// codewords.
+func (c *Code) addECC(data []byte) []byte {
+	blocks := numBlocks[c.Level][c.Version]
+	eccLen := eccPerBlock[c.Level][c.Version]
+	raw := rawModules(c.Version) / 8
+	shortBlocks := blocks - raw%blocks
+	shortLen := raw / blocks
+
+	// Every block is as long as the long blocks, and the short blocks leave
+	// their last data codeword out
+	split := make([][]byte, blocks)
+	for i, k := 0, 0; i < blocks; i++ {
+		n := shortLen - eccLen
+		if i >= shortBlocks {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		if i < shortBlocks {
+			block = append(block, 0)
+		}
+		split[i] = append(block, rsEncode(data[k-n:k], eccLen)...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for j, block := range split {
+			// Skip the padding of the short blocks
+			if i != shortLen-eccLen || j >= shortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,201 @@
+package qr
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRSEncode(t *testing.T) {
+	// The data and error correction codewords of "HELLO WORLD" as a 1-M code
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	assert.Equal(t, expected, rsEncode(data, 10))
+}
+
+func TestFormatInfo(t *testing.T) {
+	tests := []struct {
+		level    Level
+		mask     int
+		expected string
+	}{
+		{Medium, 0, "101010000010010"},
+		{Low, 4, "110011000101111"},
+		{Quartile, 7, "010101111101101"},
+		{High, 3, "001100111010000"},
+	}
+
+	for _, test := range tests {
+		bits := strconv.FormatInt(int64(formatInfo(test.level, test.mask)), 2)
+		assert.Equal(t, test.expected, strings.Repeat("0", 15-len(bits))+bits, "%s mask %d", test.level, test.mask)
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	tests := []struct {
+		version  int
+		expected string
+	}{
+		{7, "000111110010010100"},
+		{21, "010101011010000011"},
+		{40, "101000110001101001"},
+	}
+
+	for _, test := range tests {
+		bits := strconv.FormatInt(int64(versionInfo(test.version)), 2)
+		assert.Equal(t, test.expected, strings.Repeat("0", 18-len(bits))+bits, "version %d", test.version)
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	assert.Empty(t, alignmentPositions(1))
+	assert.Equal(t, []int{6, 18}, alignmentPositions(2))
+	assert.Equal(t, []int{6, 22, 38}, alignmentPositions(7))
+	assert.Equal(t, []int{6, 34, 60, 86, 112, 138}, alignmentPositions(32))
+	assert.Equal(t, []int{6, 30, 58, 86, 114, 142, 170}, alignmentPositions(40))
+}
+
+func TestEncodeVersion(t *testing.T) {
+	tests := []struct {
+		size     int
+		level    Level
+		expected int
+	}{
+		{0, Low, 1},
+		{17, Low, 1},
+		{18, Low, 2},
+		{14, Medium, 1},
+		{15, Medium, 2},
+		{230, Low, 9},
+		{271, Low, 10},
+		{1273, High, 40},
+		{2953, Low, 40},
+	}
+
+	for _, test := range tests {
+		code, err := Encode(strings.Repeat("a", test.size), test.level)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, code.Version, "%d bytes at level %s", test.size, test.level)
+		assert.Equal(t, test.expected*4+17, code.Size)
+	}
+
+	_, err := Encode(strings.Repeat("a", 2954), Low)
+	assert.Error(t, err)
+	_, err = Encode("a", Level(4))
+	assert.Error(t, err)
+}
+
+func TestEncode(t *testing.T) {
+	expected := []string{
+		"#######...#..###..#######",
+		"#.....#.###...###.#.....#",
+		"#.###.#.#.......#.#.###.#",
+		"#.###.#..#..#.###.#.###.#",
+		"#.###.#.###.#####.#.###.#",
+		"#.....#.#.#.##.##.#.....#",
+		"#######.#.#.#.#.#.#######",
+		"........#.##..##.........",
+		"##.#..##...###.##.###.##.",
+		".#..#...##.##...#.#.....#",
+		".###.####..##...#.#.#..##",
+		"....#....#######...##....",
+		"###.###...##.#..###..#.##",
+		"..#.#..###.#......##.##.#",
+		"#.#####...##.#..#.###.#.#",
+		".#.#....##.#.###.#..#..#.",
+		"##.##.#.#.#.#..########..",
+		"........#...#.#.#...##..#",
+		"#######.#..###.##.#.##.##",
+		"#.....#..#..#.#.#...####.",
+		"#.###.#.....###.######.#.",
+		"#.###.#.#..#.....#.####..",
+		"#.###.#..#...#.#...##.#.#",
+		"#.....#.######.####..#...",
+		"#######.#.#######..#...##",
+	}
+
+	code, err := Encode("https://apt.example.com/", Low)
+	require.NoError(t, err)
+	assert.Equal(t, 2, code.Version)
+	assert.Equal(t, 7, code.Mask)
+
+	var rows []string
+	for y := 0; y < code.Size; y++ {
+		var row strings.Builder
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				row.WriteByte('#')
+			} else {
+				row.WriteByte('.')
+			}
+		}
+		rows = append(rows, row.String())
+	}
+	assert.Equal(t, expected, rows)
+	assert.False(t, code.Black(-1, 0))
+	assert.False(t, code.Black(0, code.Size))
+}
+
+func TestEncodeFormat(t *testing.T) {
+	for level := Low; level <= High; level++ {
+		code, err := Encode("https://apt.example.com/cdn-cgi/access/cli?redirect_url=%2F", level)
+		require.NoError(t, err)
+
+		// Both copies of the format information must match
+		var first, second int
+		for i := 0; i < 15; i++ {
+			var x1, y1, x2, y2 int
+			switch {
+			case i < 6:
+				x1, y1 = 8, i
+			case i < 8:
+				x1, y1 = 8, i+1
+			case i == 8:
+				x1, y1 = 7, 8
+			default:
+				x1, y1 = 14-i, 8
+			}
+			if i < 8 {
+				x2, y2 = code.Size-1-i, 8
+			} else {
+				x2, y2 = 8, code.Size-15+i
+			}
+			if code.Black(x1, y1) {
+				first |= 1 << uint(i)
+			}
+			if code.Black(x2, y2) {
+				second |= 1 << uint(i)
+			}
+		}
+		assert.Equal(t, formatInfo(level, code.Mask), first, "level %s", level)
+		assert.Equal(t, first, second, "level %s", level)
+		assert.True(t, code.Black(8, code.Size-8), "the dark module must be dark")
+	}
+}
+
+func TestLines(t *testing.T) {
+	code, err := Encode("https://apt.example.com/", Low)
+	require.NoError(t, err)
+
+	width := code.Size + 2*QuietZone
+	lines := code.Lines(false)
+	require.Len(t, lines, (width+1)/2)
+	for _, line := range lines {
+		assert.Equal(t, width, utf8.RuneCountInString(line))
+	}
+
+	// The quiet zone is light, and so drawn, and the finder pattern's
+	// outer ring is dark, and so blank
+	assert.Equal(t, strings.Repeat("█", width), lines[0])
+	assert.True(t, strings.HasPrefix(lines[2], "████ ▄▄▄▄▄ █"), lines[2])
+
+	inverted := code.Lines(true)
+	assert.Equal(t, strings.Repeat(" ", width), inverted[0])
+	assert.True(t, strings.HasPrefix(inverted[2], "    █▀▀▀▀▀█ "), inverted[2])
+
+	assert.Equal(t, strings.Join(lines, "\n")+"\n", code.String())
+}
@@ -0,0 +1,48 @@
+package qr
+
+import "strings"
+
+// QuietZone is the width, in modules, of the light border drawn around a
+// code, which scanners need to find it.
+const QuietZone = 4
+
+// Lines renders the code as lines of text for a terminal, using UTF-8 half
+// block characters so that each line holds two rows of modules.
+//
+// Light modules, including the quiet zone, are drawn with the block
+// characters and dark modules are left blank, so that the code reads
+// correctly as light text on a dark background, which most terminals use. If
+// invert is set, dark modules are drawn instead, for dark text on a light
+// background.
+func (c *Code) Lines(invert bool) []string {
+	ink := func(x, y int) bool {
+		return c.Black(x, y) == invert
+	}
+
+	var lines []string
+	for y := -QuietZone; y < c.Size+QuietZone; y += 2 {
+		var line strings.Builder
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			top := ink(x, y)
+			bottom := y+1 < c.Size+QuietZone && ink(x, y+1)
+			switch {
+			case top && bottom:
+				line.WriteString("█")
+			case top:
+				line.WriteString("▀")
+			case bottom:
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// String renders the code as text for a terminal with a dark background. See
+// Lines.
+func (c *Code) String() string {
+	return strings.Join(c.Lines(false), "\n") + "\n"
+}
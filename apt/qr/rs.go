@@ -0,0 +1,53 @@
+package qr
+
+// gfPoly is the polynomial x^8 + x^4 + x^3 + x^2 + 1, which defines the
+// Galois field GF(256) the Reed-Solomon codes of QR codes use.
+const gfPoly = 0x11d
+
+// gfMul multiplies two elements of GF(256).
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * gfPoly)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsGenerator returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, (x - a^0)(x - a^1)...(x - a^(degree-1))
+// with a = 2, from the highest power down. The leading coefficient, which is
+// always 1, is left out.
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		// Multiply by (x - root), which is (x + root) in GF(256)
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+// rsEncode returns the n Reed-Solomon error correction codewords for the
+// data: the remainder of dividing the data, times x^n, by the generator.
+func rsEncode(data []byte, n int) []byte {
+	gen := rsGenerator(n)
+	ecc := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ ecc[0]
+		copy(ecc, ecc[1:])
+		ecc[n-1] = 0
+		for i, coef := range gen {
+			ecc[i] ^= gfMul(coef, factor)
+		}
+	}
+	return ecc
+}
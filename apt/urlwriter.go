@@ -2,33 +2,61 @@ package apt
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/cloudflare/apt-transport-cloudflared/apt/access"
 )
 
-// URLWriter is a io.Writer which only writes URLS
+// urlPattern matches the URLs in a line of output. Punctuation which ends a
+// sentence is trimmed off the match afterwards, and only the URLs of Access
+// logins are kept.
+var urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// URLWriter is a io.Writer which only writes the URLs of Access logins, such
+// as the Access CLI login URL cloudflared prints, and not links to
+// documentation or other sites the output may contain.
+//
+// Each URL is passed on only the first time it is seen, so a login URL
+// printed more than once is shown once. Login URLs are all on the Access team
+// domain, but differ for each application and each login, so every login is
+// still shown. It is safe to share a URLWriter between several subprocesses.
 type URLWriter struct {
-	writer io.Writer
+	mu     sync.Mutex
+	emit   func(url string)
 	buffer bytes.Buffer
-	prefix string
+	seen   map[string]bool
 }
 
-// NewURLWriter creates a new URLWriter instance.
+// NewURLWriter creates a new URLWriter instance which writes each URL to w on
+// its own line, with the prefix prepended.
 func NewURLWriter(w io.Writer, prefix string) *URLWriter {
+	return NewURLWriterFunc(func(url string) {
+		fmt.Fprintf(w, "\r%s%s\n", prefix, url)
+	})
+}
+
+// NewURLWriterFunc creates a new URLWriter instance which calls emit with
+// each URL, e.g. to show it in a message to apt.
+func NewURLWriterFunc(emit func(url string)) *URLWriter {
 	return &URLWriter{
-		writer: w,
-		buffer: bytes.Buffer{},
-		prefix: prefix,
+		emit: emit,
+		seen: make(map[string]bool),
 	}
 }
 
 // Write implements the io.Writer interface.
 //
-// Write buffers data until it hits a newline, at which point it checks if the
-// buffered data is a URL. If it is, it writes that URL to the MessageWriter
-// instance it was created with, along with the prefix prepended.
+// Write buffers data until it hits a newline, at which point it looks for
+// URLs anywhere in the buffered line and emits those it hasn't seen before.
 func (uw *URLWriter) Write(data []byte) (int, error) {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+
 	start := 0
 	for i, b := range data {
 		// If we hit a newline, copy data[start:i] into the buffer and commit
@@ -44,20 +72,20 @@ func (uw *URLWriter) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
-// commit takes a line from the buffer and checks if it is a url. If it is,
-// then it writes the URL using the message writer.
+// commit takes a line from the buffer and emits the URLs in it.
 func (uw *URLWriter) commit() {
-	// Pull data from buffer, trim off spaces
-	line := strings.TrimSpace(uw.buffer.String())
-	if strings.HasPrefix(line, "http") {
-		// Check if we have a URL, and if so print it
-		_, err := url.Parse(line)
-		if err == nil {
-			uw.writer.Write([]byte("\r"))
-			uw.writer.Write([]byte(uw.prefix))
-			uw.writer.Write([]byte(line))
-			uw.writer.Write([]byte("\n"))
+	for _, match := range urlPattern.FindAllString(uw.buffer.String(), -1) {
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		uri, err := url.Parse(match)
+		if err != nil || uri.Host == "" || !access.IsAuthURL(uri) {
+			continue
+		}
+
+		if uw.seen[match] {
+			continue
 		}
+		uw.seen[match] = true
+		uw.emit(match)
 	}
 
 	// Clear the buffer regardless
@@ -3,6 +3,8 @@ package apt
 import (
 	"bytes"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestURLWriter(t *testing.T) {
@@ -14,8 +16,57 @@ func TestURLWriter(t *testing.T) {
 		t.Errorf("Expected no output from non-url input")
 	}
 
-	urlw.Write([]byte("Header line\nhttps://httpbin.org/get\nTrailing line\n"))
-	if output.String() != "\rURL: https://httpbin.org/get\n" {
+	urlw.Write([]byte("Header line\nhttps://apt.example.com/cdn-cgi/access/cli\nTrailing line\n"))
+	if output.String() != "\rURL: https://apt.example.com/cdn-cgi/access/cli\n" {
 		t.Errorf("Unexpected output: %q\n", output.String())
 	}
 }
+
+func TestURLWriterFunc(t *testing.T) {
+	var urls []string
+	urlw := NewURLWriterFunc(func(url string) { urls = append(urls, url) })
+
+	urlw.Write([]byte("Please open the following URL and log in: "))
+	assert.Empty(t, urls, "incomplete lines are buffered")
+
+	urlw.Write([]byte("https://apt.example.com/cdn-cgi/access/cli?token=abc.\n"))
+	urlw.Write([]byte("A browser window should have opened (https://apt.example.com/cdn-cgi/access/cli?token=def)\n"))
+	urlw.Write([]byte("Log in at <http://apt.example.com:8080/cdn-cgi/access/cli?token=ghi>\n"))
+	urlw.Write([]byte("Not a URL: https:// nor ftp://apt.example.com/cdn-cgi/access/cli\n"))
+
+	assert.Equal(t, []string{
+		"https://apt.example.com/cdn-cgi/access/cli?token=abc",
+		"https://apt.example.com/cdn-cgi/access/cli?token=def",
+		"http://apt.example.com:8080/cdn-cgi/access/cli?token=ghi",
+	}, urls)
+}
+
+func TestURLWriterOtherURLs(t *testing.T) {
+	var urls []string
+	urlw := NewURLWriterFunc(func(url string) { urls = append(urls, url) })
+
+	// Links which aren't for logging in aren't shown to the user
+	urlw.Write([]byte("See https://developers.cloudflare.com/cloudflare-one/ for help\n"))
+	urlw.Write([]byte("Unable to reach https://apt.example.com/dists/stable/InRelease: timeout\n"))
+	urlw.Write([]byte("Fetching https://team.example.com/cdn-cgi/access/certs\n"))
+
+	assert.Empty(t, urls)
+}
+
+func TestURLWriterTeamDomain(t *testing.T) {
+	var urls []string
+	urlw := NewURLWriterFunc(func(url string) { urls = append(urls, url) })
+
+	// The login URLs for every application are on the team domain
+	first := "https://example.cloudflareaccess.com/cdn-cgi/access/cli?aud=aud-1" +
+		"&redirect_url=https%3A%2F%2Fapt.example.com%2F&token=abc"
+	second := "https://example.cloudflareaccess.com/cdn-cgi/access/cli?aud=aud-2" +
+		"&redirect_url=https%3A%2F%2Fdebian.example.com%2F&token=def"
+
+	urlw.Write([]byte("Please open the following URL and log in with your Cloudflare account:\n\n" + first + "\n"))
+	urlw.Write([]byte("Leave cloudflared running to download the token automatically.\n"))
+	urlw.Write([]byte("A browser window should have opened at the following URL:\n\n" + first + "\n"))
+	urlw.Write([]byte("Please open the following URL and log in with your Cloudflare account:\n\n" + second + "\n"))
+
+	assert.Equal(t, []string{first, second}, urls)
+}